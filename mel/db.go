@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"errors"
+	"strconv"
 
 	"github.com/golang/glog"
 	"go.mongodb.org/mongo-driver/bson"
@@ -22,6 +23,9 @@ var clusterDB *mongo.Database
 var bundleCltn *mongo.Collection
 var summaryCltn *mongo.Collection
 var errRecCltn *mongo.Collection
+var userCltn *mongo.Collection
+var componentCltn *mongo.Collection
+var statusCltn *mongo.Collection
 
 func ClusterGetDBName(cl string) string {
 	return ("Cluster-" + cl + "-DB")
@@ -52,23 +56,114 @@ func DBConnect() bool {
 	clusterCfgCltn = clusterDB.Collection("NxtTenants")
 	clusterGwCltn = clusterDB.Collection("NxtGateways")
 	errRecCltn = clusterDB.Collection("NxtErrRec")
+	userCltn = clusterDB.Collection("NxtUsers")
+	componentCltn = clusterDB.Collection("NxtComponents")
+	statusCltn = clusterDB.Collection("NxtStatus")
 
 	return true
 }
 
 type ConnectorSummary struct {
-	Id        string `bson:"_id"`
-	Image     string `bson:"image"`
-	Connectid string `bson:"connectid"`
-	CpodRepl  int    `bson:"cpodrepl"`
+	Id         string       `bson:"_id"`
+	Image      string       `bson:"image"`
+	Connectid  string       `bson:"connectid"`
+	CpodRepl   int          `bson:"cpodrepl"`
+	Resources  PodResources `bson:"resources"`
+	Canary     bool         `bson:"canary"`     // running the tenant's canary image
+	Draining   bool         `bson:"draining"`   // being drained before its deleted
+	DrainStart int64        `bson:"drainstart"` // unix seconds the drain started at
 }
 
 type TenantSummary struct {
-	Tenant     string             `bson:"_id"`
-	Image      string             `bson:"image"`
-	ApodRepl   int                `bson:"apodrepl"`
-	ApodSets   int                `bson:"apodsets"`
-	Connectors []ConnectorSummary `bson:"connectors"`
+	Tenant          string             `bson:"_id"`
+	Image           string             `bson:"image"`
+	ApodRepl        int                `bson:"apodrepl"`
+	ApodSets        int                `bson:"apodsets"`
+	Connectors      []ConnectorSummary `bson:"connectors"`
+	RolloutFailed   string             `bson:"rolloutfailed"`   // image a rolling upgrade failed on, skipped till Image changes
+	RolloutImage    string             `bson:"rolloutimage"`    // image of the rolling upgrade in progress
+	RolloutSets     int                `bson:"rolloutsets"`     // apod sets already on RolloutImage
+	CanaryImage     string             `bson:"canaryimage"`     // canary image some of the cpods are on, if any
+	ApodMaxRepl     int                `bson:"apodmaxrepl"`     // apod sets are autoscaled if non zero
+	ApodSetRepl     map[string]int     `bson:"apodsetrepl"`     // autoscaled replicas of each apod set, its per-replica services and routes follow it
+	ApodSetsDyn     int                `bson:"apodsetsdyn"`     // apod sets mel picked based on the user load
+	ApodSetDraining string             `bson:"apodsetdraining"` // apod set being drained before its removed
+	Quota           TenantQuota        `bson:"quota"`           // quota applied to the namespace
+	NetPolicyAllow  []string           `bson:"netpolicyallow"`  // namespaces let in by the applied exceptions
+	SecretHash      string             `bson:"secrethash"`      // hash of the tenant secret applied
+	SecretVersion   int                `bson:"secretversion"`   // bumped on a secret change to roll the pods
+	Terminating     string             `bson:"terminating"`     // stage of the tenant delete, empty if not being deleted
+	ConnectorDrain  int                `bson:"connectordrain"`  // kept to drain connectors after the config is gone
+	RRVersion       string             `bson:"rrversion"`       // hash of the route reflector applied
+	Tracing         string             `bson:"tracing"`         // exporter of the collector, empty if tracing is off
+}
+
+// The cluster wide components mel manages (consul), Version is the version of the
+// manifest last applied and Status is how the component is doing since ChangeAt.
+// Remotes are the clusters consul is WAN federated with
+type ComponentSummary struct {
+	Name     string   `bson:"_id"`
+	Version  string   `bson:"version"`
+	WanIP    string   `bson:"wanip"`
+	Storage  string   `bson:"storage"`
+	Status   string   `bson:"status"`
+	ChangeAt string   `bson:"changeat"`
+	Remotes  []string `bson:"remotes"`
+}
+
+func DBFindComponentSummary(name string) (error, *ComponentSummary) {
+	if unitTesting {
+		mongoErr := GetEnv("TEST_MONGO_ERR", "NOT_TEST")
+		if mongoErr == "true" {
+			glog.Error("Mongo UT error")
+			return errors.New("Mongo unit test error"), nil
+		}
+	}
+
+	var summary ComponentSummary
+	err := componentCltn.FindOne(
+		context.TODO(),
+		bson.M{"_id": name},
+	).Decode(&summary)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return err, nil
+	}
+	return nil, &summary
+}
+
+func DBUpdateComponentSummary(summary *ComponentSummary) error {
+	if unitTesting {
+		mongoErr := GetEnv("TEST_MONGO_ERR", "NOT_TEST")
+		if mongoErr == "true" {
+			glog.Error("Mongo UT error")
+			return errors.New("Mongo unit test error")
+		}
+	}
+
+	// The upsert option asks the DB to add if one is not found
+	upsert := true
+	after := options.After
+	opt := options.FindOneAndUpdateOptions{
+		ReturnDocument: &after,
+		Upsert:         &upsert,
+	}
+	err := componentCltn.FindOneAndUpdate(
+		context.TODO(),
+		bson.M{"_id": summary.Name},
+		bson.D{
+			{"$set", summary},
+		},
+		&opt,
+	)
+
+	if err.Err() != nil {
+		return err.Err()
+	}
+
+	return nil
 }
 
 func DBFindAllTenantSummary() (error, []TenantSummary) {
@@ -173,6 +268,125 @@ func DBDeleteTenantSummary(tenant string) error {
 	return nil
 }
 
+//---------------------------Tenant Status Collection functions---------------------------
+
+// The status of a tenant or a connector as deployed in this cluster, for the controller
+// to look at. The tenant's status has the tenant as the Id and Connectid empty, the
+// connector's status has the connector's id (tenant:bundle) as the Id. ObservedVersion
+// is the config version mel last saw and AppliedVersion is the version last applied
+// successfully. ReadyVersion is the version whose pods all came up ready after the
+// apply. The replicas are of the apod sets for a tenant and of the cpod for a
+// connector. TransitionAt is when the status last moved into its Phase
+type Status struct {
+	Id              string `bson:"_id"`
+	Tenant          string `bson:"tenant"`
+	Connectid       string `bson:"connectid"`
+	ObservedVersion int    `bson:"observedversion"`
+	AppliedVersion  int    `bson:"appliedversion"`
+	ReadyVersion    int    `bson:"readyversion"`
+	Phase           string `bson:"phase"`
+	Replicas        int    `bson:"replicas"`
+	ReadyReplicas   int    `bson:"readyreplicas"`
+	LastError       string `bson:"lasterror"`
+	TransitionAt    string `bson:"transitionat"`
+}
+
+func DBFindStatus(id string) (error, *Status) {
+	if unitTesting {
+		mongoErr := GetEnv("TEST_MONGO_ERR", "NOT_TEST")
+		if mongoErr == "true" {
+			glog.Error("Mongo UT error")
+			return errors.New("Mongo unit test error"), nil
+		}
+	}
+
+	var status Status
+	err := statusCltn.FindOne(
+		context.TODO(),
+		bson.M{"_id": id},
+	).Decode(&status)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return err, nil
+	}
+	return nil, &status
+}
+
+func DBUpdateStatus(status *Status) error {
+	if unitTesting {
+		mongoErr := GetEnv("TEST_MONGO_ERR", "NOT_TEST")
+		if mongoErr == "true" {
+			glog.Error("Mongo UT error")
+			return errors.New("Mongo unit test error")
+		}
+	}
+
+	// The upsert option asks the DB to add if one is not found
+	upsert := true
+	after := options.After
+	opt := options.FindOneAndUpdateOptions{
+		ReturnDocument: &after,
+		Upsert:         &upsert,
+	}
+	err := statusCltn.FindOneAndUpdate(
+		context.TODO(),
+		bson.M{"_id": status.Id},
+		bson.D{
+			{"$set", status},
+		},
+		&opt,
+	)
+
+	if err.Err() != nil {
+		return err.Err()
+	}
+
+	return nil
+}
+
+func DBDeleteStatus(id string) error {
+	if unitTesting {
+		mongoErr := GetEnv("TEST_MONGO_ERR", "NOT_TEST")
+		if mongoErr == "true" {
+			glog.Error("Mongo UT error")
+			return errors.New("Mongo unit test error")
+		}
+	}
+
+	_, err := statusCltn.DeleteOne(
+		context.TODO(),
+		bson.M{"_id": id},
+	)
+
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Delete the status of the tenant and all its connectors
+func DBDeleteTenantStatus(tenant string) error {
+	if unitTesting {
+		mongoErr := GetEnv("TEST_MONGO_ERR", "NOT_TEST")
+		if mongoErr == "true" {
+			glog.Error("Mongo UT error")
+			return errors.New("Mongo unit test error")
+		}
+	}
+
+	_, err := statusCltn.DeleteMany(
+		context.TODO(),
+		bson.M{"tenant": tenant},
+	)
+
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
 // NOTE: The bson decoder will not work if the structure field names dont start with upper case
 type ClusterGateway struct {
 	Name    string   `json:"name" bson:"_id"`
@@ -205,14 +419,65 @@ func DBFindGatewayCluster(gwname string) (error, *ClusterGateway) {
 	return nil, &gateway
 }
 
+// Quotas for the tenant's namespace, each one is optional. The cpu and memory
+// quotas are on the total requests of all pods, the DefaultCpu/DefaultMemory
+// are the requests for containers that dont ask for anything themselves. With
+// a cpu/memory quota, the default request defaults to 100m cpu/128Mi memory
+type TenantQuota struct {
+	Cpu           string `json:"cpu" bson:"cpu"`
+	Memory        string `json:"memory" bson:"memory"`
+	Pods          int    `json:"pods" bson:"pods"`
+	Services      int    `json:"services" bson:"services"`
+	DefaultCpu    string `json:"defaultcpu" bson:"defaultcpu"`
+	DefaultMemory string `json:"defaultmemory" bson:"defaultmemory"`
+}
+
+// Rollout set to "rolling" upgrades the apod sets one at a time when the Image
+// changes, waiting for each set to be ready (for RolloutTimeout seconds) before
+// moving on to the next one. RolloutRevert puts a set that failed to become
+// ready back on the image it was running before, right away. A failed image is
+// not tried again, the sets stay on the old image till the Image changes.
+// CanaryImage is run on the cpods of the connectors listed in CanaryConnectors
+// plus CanaryPercent percent of the rest of the connectors, all other cpods
+// run the Image. To promote the canary, set Image to the canary image and
+// clear CanaryImage, to abort the canary just clear CanaryImage.
+// If ApodMaxRepl is set, the apod sets are autoscaled between ApodMinRepl and
+// ApodMaxRepl replicas based on ApodCpuTarget percentage of cpu utilization.
+// If ApodSetsMax is more than ApodSets, mel adds apod sets (upto ApodSetsMax)
+// when all the sets have more than ApodSetUsers users, and removes empty sets
+// (down to ApodSets) when the load goes down.
 type ClusterConfig struct {
-	Id       string `json:"id" bson:"_id"` //TenantID
-	Cluster  string `json:"cluster" bson:"cluster"`
-	Tenant   string `json:"tenant" bson:"tenant"`
-	Image    string `json:"image" bson:"image"`
-	ApodRepl int    `json:"apodrepl" bson:"apodrepl"`
-	ApodSets int    `json:"apodsets" bson:"apodsets"`
-	Version  int    `json:"version" bson:"version"`
+	Id                   string            `json:"id" bson:"_id"` //TenantID
+	Cluster              string            `json:"cluster" bson:"cluster"`
+	Tenant               string            `json:"tenant" bson:"tenant"`
+	Image                string            `json:"image" bson:"image"`
+	ApodRepl             int               `json:"apodrepl" bson:"apodrepl"`
+	ApodSets             int               `json:"apodsets" bson:"apodsets"`
+	Version              int               `json:"version" bson:"version"`
+	Rollout              string            `json:"rollout" bson:"rollout"`                           // "rolling" or empty for all sets at once
+	RolloutTimeout       int               `json:"rollouttimeout" bson:"rollouttimeout"`             // seconds for each set to be ready
+	RolloutRevert        bool              `json:"rolloutrevert" bson:"rolloutrevert"`               // put a failed set back on its old image
+	CanaryImage          string            `json:"canaryimage" bson:"canaryimage"`                   // empty when there is no canary
+	CanaryConnectors     []string          `json:"canaryconnectors" bson:"canaryconnectors"`         // connectors always on the canary
+	CanaryPercent        int               `json:"canarypercent" bson:"canarypercent"`               // percent of the other connectors on the canary
+	ApodMinRepl          int               `json:"apodminrepl" bson:"apodminrepl"`                   // autoscale floor
+	ApodMaxRepl          int               `json:"apodmaxrepl" bson:"apodmaxrepl"`                   // autoscale ceiling, zero does not autoscale
+	ApodCpuTarget        int               `json:"apodcputarget" bson:"apodcputarget"`               // cpu utilization percent to autoscale on
+	ApodSetsMax          int               `json:"apodsetsmax" bson:"apodsetsmax"`                   // apod sets are added upto this many
+	ApodSetUsers         int               `json:"apodsetusers" bson:"apodsetusers"`                 // users per apod set before one is added
+	Quota                TenantQuota       `json:"quota" bson:"quota"`                               // quota of the namespace
+	NetPolicyAllow       []string          `json:"netpolicyallow" bson:"netpolicyallow"`             // namespaces let in besides the gateways and consul
+	CostCentre           string            `json:"costcentre" bson:"costcentre"`                     // namespace label
+	PodSecurity          string            `json:"podsecurity" bson:"podsecurity"`                   // pod security level to enforce, privileged if empty
+	PodSecurityWarn      string            `json:"podsecuritywarn" bson:"podsecuritywarn"`           // pod security level to warn and audit
+	NamespaceLabels      map[string]string `json:"namespacelabels" bson:"namespacelabels"`           // more namespace labels
+	NamespaceAnnotations map[string]string `json:"namespaceannotations" bson:"namespaceannotations"` // namespace annotations
+	ConnectorDrain       int               `json:"connectordrain" bson:"connectordrain"`             // seconds for a deleted connector to drain, zero does not wait
+	RRImage              string            `json:"rrimage" bson:"rrimage"`                           // route reflector image, the default if empty
+	RRRepl               int               `json:"rrrepl" bson:"rrrepl"`                             // route reflector replicas
+	RRResources          PodResources      `json:"rrresources" bson:"rrresources"`                   // route reflector resources
+	Tracing              bool              `json:"tracing" bson:"tracing"`                           // run an opentelemetry collector for the jaeger agents
+	TracingExporter      string            `json:"tracingexporter" bson:"tracingexporter"`           // where the collector exports to, mel's default if empty
 }
 
 // Find a specific tenant  within a cluster
@@ -267,16 +532,29 @@ func DBFindAllTenantsInCluster() (error, []ClusterConfig) {
 	return nil, nil
 }
 
+// Optional overrides for the resources and placement of a pod. Empty values
+// mean we dont set anything and let kubernetes go with its defaults
+type PodResources struct {
+	CpuRequest   string            `json:"cpurequest" bson:"cpurequest"`
+	CpuLimit     string            `json:"cpulimit" bson:"cpulimit"`
+	MemRequest   string            `json:"memrequest" bson:"memrequest"`
+	MemLimit     string            `json:"memlimit" bson:"memlimit"`
+	NodeSelector map[string]string `json:"nodeselector" bson:"nodeselector"`
+}
+
 // The Pod here indicates the "pod set" that this user should
 // connect to, each pod set has its own number of replicas etc..
+// The Image if set overrides the tenant wide image for this connector
 type ClusterBundle struct {
-	Uid       string   `json:"uid" bson:"_id"`
-	Tenant    string   `json:"tenant" bson:"tenant"`
-	Pod       string   `json:"pod" bson:"pod"`
-	Connectid string   `json:"connectid" bson:"connectid"`
-	Services  []string `json:"services" bson:"services"`
-	Version   int      `json:"version" bson:"version"`
-	CpodRepl  int      `json:"cpodrepl" bson:"cpodrepl"`
+	Uid       string       `json:"uid" bson:"_id"`
+	Tenant    string       `json:"tenant" bson:"tenant"`
+	Pod       string       `json:"pod" bson:"pod"`
+	Connectid string       `json:"connectid" bson:"connectid"`
+	Services  []string     `json:"services" bson:"services"`
+	Version   int          `json:"version" bson:"version"`
+	CpodRepl  int          `json:"cpodrepl" bson:"cpodrepl"`
+	Image     string       `json:"image" bson:"image"`
+	Resources PodResources `json:"resources" bson:"resources"`
 }
 
 // Find a specific tenant's connector within a cluster
@@ -330,8 +608,55 @@ func DBFindAllClusterBundlesForTenant(tenant string) (error, []ClusterBundle) {
 	return nil, bundles
 }
 
+//---------------------------Cluster Users Collection functions---------------------------
+
+// NxtUsers is written by the controller, one doc per user (agent) in this cluster,
+// and mel only reads it. All mel relies on is the "pod" field of the doc, a string
+// that is the name of the apod set (<tenant>-apod<n>) the controller pinned the
+// user to. Dynamic apod sets need the controller to keep these docs up to date
+
+// Count the users docs that dont have the pod mel relies on
+func DBCheckUsersSchema() error {
+	if unitTesting {
+		mongoErr := GetEnv("TEST_MONGO_ERR", "NOT_TEST")
+		if mongoErr == "true" {
+			glog.Error("Mongo UT error")
+			return errors.New("Mongo unit test error")
+		}
+	}
+
+	// Matches the docs without a pod too
+	count, err := userCltn.CountDocuments(context.TODO(), bson.M{"pod": bson.M{"$not": bson.M{"$type": "string"}}})
+	if err != nil {
+		return err
+	}
+	if count != 0 {
+		return errors.New(strconv.FormatInt(count, 10) + " NxtUsers docs without a pod")
+	}
+	return nil
+}
+
+func DBCountApodSetUsers(podname string) (error, int64) {
+	if unitTesting {
+		mongoErr := GetEnv("TEST_MONGO_ERR", "NOT_TEST")
+		if mongoErr == "true" {
+			glog.Error("Mongo UT error")
+			return errors.New("Mongo unit test error"), 0
+		}
+	}
+
+	count, err := userCltn.CountDocuments(context.TODO(), bson.M{"pod": podname})
+	if err != nil {
+		return err, 0
+	}
+	return nil, count
+}
+
 //---------------------------Tenant ErrRec Collection functions---------------------------
 
+// Type is set for errors that need specific attention, like "QuotaExceeded".
+// For "NotReady" errors, Connectid is the StatefulSet that did not become ready
+// and Reason is why its pods are waiting, like "CrashLoopBackOff" or "QuotaExceeded"
 type ErrRec struct {
 	Tenant     string
 	Connectid  string
@@ -339,6 +664,8 @@ type ErrRec struct {
 	Collection string
 	Error      string
 	ChangeAt   string
+	Type       string
+	Reason     string
 }
 
 // Today there is either errors per tenant or there is errors for gateways (applicable to all tenants)
@@ -346,6 +673,10 @@ type ErrRec struct {
 // if we have more kind of errors, this will need changing
 func DBErrToKey(data *ErrRec) string {
 	key := ""
+	if data.Type == "NotReady" {
+		// One per StatefulSet, not to be mixed up with errors of the tenant's configs
+		return "notready-" + data.Tenant + "-" + data.Connectid
+	}
 	if data.Tenant == "" && data.Connectid == "" {
 		key = "gateway-"
 	} else if data.Tenant != "" {
@@ -366,7 +697,7 @@ func DBAddErrRec(data *ErrRec) error {
 		context.TODO(),
 		bson.M{"key": DBErrToKey(data)},
 		bson.D{
-			{"$set", bson.M{"key": DBErrToKey(data), "changeat": data.ChangeAt}},
+			{"$set", bson.M{"key": DBErrToKey(data), "changeat": data.ChangeAt, "type": data.Type, "reason": data.Reason}},
 		},
 		&opt,
 	)
@@ -375,3 +706,22 @@ func DBAddErrRec(data *ErrRec) error {
 	}
 	return nil
 }
+
+func DBDelErrRec(data *ErrRec) error {
+	if unitTesting {
+		mongoErr := GetEnv("TEST_MONGO_ERR", "NOT_TEST")
+		if mongoErr == "true" {
+			glog.Error("Mongo UT error")
+			return errors.New("Mongo unit test error")
+		}
+	}
+
+	_, err := errRecCltn.DeleteOne(
+		context.TODO(),
+		bson.M{"key": DBErrToKey(data)},
+	)
+	if err != nil {
+		return err
+	}
+	return nil
+}
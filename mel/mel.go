@@ -1,16 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -33,6 +40,15 @@ var ConsulWanIP string
 var ConsulStorage string
 var MyMongo string
 var MyJaeger string
+var IngressPrincipal string
+var PullSecrets []string
+var ConsulRemotes []string
+var OtelExporter string
+var ApplyForceKinds []string
+var DebugDir string
+
+// All our applies are server side applies as this field manager
+const fieldManager = "nextensio-mel"
 
 type bundleInfo struct {
 	version   int
@@ -43,6 +59,7 @@ type tenantInfo struct {
 	markSweep     bool
 	tenantSummary *TenantSummary
 	deployVersion int
+	deployedAt    time.Time
 	bundleInfo    map[string]*bundleInfo
 }
 
@@ -57,7 +74,40 @@ var eGwVersion int
 type ErrStack []*ErrRec
 
 var errRecList map[string]*ErrStack
+
+// The eLock is held while working on the tenants, and the errLock while working on
+// the errRecList. Errors can be added with the eLock held, never the other way round
 var eLock sync.RWMutex
+var errLock sync.Mutex
+
+// kubectl apply fails with this if the tenant's namespace is out of quota
+var errQuotaExceeded = errors.New("QuotaExceeded")
+
+// Not really an error, a connector delete waiting for the connector to drain is
+// retried like any other error but its not recorded as a failure
+var errConnectorDraining = errors.New("ConnectorDraining")
+
+// The pods of an applied StatefulSet did not become ready in time
+var errNotReady = errors.New("NotReady")
+
+// A server side apply ran into fields owned by some other field manager
+var errApplyConflict = errors.New("ApplyConflict")
+
+func errType(err error) string {
+	if errors.Is(err, errQuotaExceeded) {
+		return "QuotaExceeded"
+	}
+	if errors.Is(err, errConnectorDraining) {
+		return "ConnectorDraining"
+	}
+	if errors.Is(err, errNotReady) {
+		return "NotReady"
+	}
+	if errors.Is(err, errApplyConflict) {
+		return "ApplyConflict"
+	}
+	return ""
+}
 
 func PushErr(v *ErrRec) {
 	key := DBErrToKey(v)
@@ -76,6 +126,25 @@ func PushErr(v *ErrRec) {
 	}
 }
 
+// Queue a delete of the connector for the retries, unless one is queued already
+func retryConnectorDelete(tenant string, id string, errMsg string, err error) {
+	errLock.Lock()
+	for _, stack := range errRecList {
+		if stack == nil {
+			continue
+		}
+		for _, s := range *stack {
+			if s.Collection == "NxtConnectors" && s.Operation == "delete" &&
+				s.Tenant == tenant && s.Connectid == id {
+				errLock.Unlock()
+				return
+			}
+		}
+	}
+	errLock.Unlock()
+	addError(err, errMsg, "delete", "NxtConnectors", tenant, id)
+}
+
 func DelErr(key string, i int) {
 	s := errRecList[key]
 	s1 := append((*s)[:i], (*s)[i+1:]...)
@@ -107,13 +176,21 @@ func errRetryProcess() {
 	errRecCltn.Drop(context.TODO())
 
 	for {
-		eLock.Lock()
+		waitKubeApi()
+		// Retry a copy of the list, errors added while the retries run are picked up
+		// in the next round
+		retries := make(map[string]ErrStack)
+		errLock.Lock()
 		for key, stack := range errRecList {
-			if stack == nil {
-				continue
+			if stack != nil {
+				retries[key] = append(ErrStack(nil), (*stack)...)
 			}
-			var arrDelIdx []int
-			for index, s := range *stack {
+		}
+		errLock.Unlock()
+		eLock.Lock()
+		for key, stack := range retries {
+			var done []*ErrRec
+			for _, s := range stack {
 				var err error
 				errMsg := fnLine()
 				var clcfg *ClusterConfig
@@ -156,28 +233,42 @@ func errRetryProcess() {
 					errMsg, err = createEgressGateways()
 				}
 				if err != nil {
+					errLock.Lock()
 					s.Error = errMsg
+					s.Type = errType(err)
+					errLock.Unlock()
 					// We store minimal info in the database just to indicate to whoever
 					// wants to know (controller ?) that there was some error processing
 					// configs for this tenant. We "can" store a lot more detailed info here
 					// but thats pbbly of no use because if there is an error like this, an
 					// engineer has to be involved anyways, not much customer can do by seeing
 					// the error details on controller
-					DBAddErrRec(s)
+					if !errors.Is(err, errConnectorDraining) {
+						DBAddErrRec(s)
+					}
+					if s.Collection != "NxtGateways" {
+						opStatus(s.Tenant, s.Connectid, s.Operation, err, errMsg)
+					}
 					glog.Info("ErrorRetry failed")
 				} else {
-					// Can't delete entries in array while processing the array in loop so,
-					// save the index to be deleted after the loop is processed
-					arrDelIdx = append(arrDelIdx, index)
+					// The failure was published when it first happened, now say it went through
+					recordEvent(s.Tenant, s.Connectid, s.Collection, s.Operation, nil, "")
+					opStatus(s.Tenant, s.Connectid, s.Operation, nil, "")
+					done = append(done, s)
 				}
 			}
-			if len(arrDelIdx) > 0 {
-				// Now call the DelErr in reverse to avoid index
-				for idx := range arrDelIdx {
-					idx = len(arrDelIdx) - 1 - idx
-					// now k starts from the end
-					DelErr(key, arrDelIdx[idx])
+			if len(done) > 0 {
+				// The list might have grown meanwhile, so find the done ones again
+				errLock.Lock()
+				for _, d := range done {
+					for index, s := range *errRecList[key] {
+						if s == d {
+							DelErr(key, index)
+							break
+						}
+					}
 				}
+				errLock.Unlock()
 			}
 		}
 		eLock.Unlock()
@@ -186,7 +277,7 @@ func errRetryProcess() {
 }
 
 func dumpErrors() {
-	eLock.Lock()
+	errLock.Lock()
 	for key, stack := range errRecList {
 		if stack == nil {
 			continue
@@ -196,7 +287,7 @@ func dumpErrors() {
 			glog.Infof("dumpErrors: %v", *s)
 		}
 	}
-	eLock.Unlock()
+	errLock.Unlock()
 }
 
 func addError(err error, errMsg string, op string, collection string, tenant string, connector string) {
@@ -207,19 +298,25 @@ func addError(err error, errMsg string, op string, collection string, tenant str
 	errRec := ErrRec{
 		Tenant: tenant, Operation: op, Collection: collection,
 		Error: errMsg + ":" + err.Error(), Connectid: connector, ChangeAt: timenow,
+		Type: errType(err),
 	}
-	eLock.Lock()
+	errLock.Lock()
 	PushErr(&errRec)
-	eLock.Unlock()
+	errLock.Unlock()
 }
 
 func watchClusterDB(cDB *mongo.Database) {
 	var cs *mongo.ChangeStream
 	var err error
 
+	// Only the configs are of interest, mel itself writes the summaries, statuses etc..
+	// to the same db and those should not come back to us as changes
+	pipeline := mongo.Pipeline{
+		{{"$match", bson.M{"ns.coll": bson.M{"$in": bson.A{"NxtTenants", "NxtConnectors", "NxtGateways"}}}}},
+	}
 	// Watch the cluster db. Retry for 5 times before bailing out of watch
 	for retries := 5; retries > 0; retries-- {
-		cs, err = cDB.Watch(context.TODO(), mongo.Pipeline{}, options.ChangeStream().SetFullDocument(options.UpdateLookup))
+		cs, err = cDB.Watch(context.TODO(), pipeline, options.ChangeStream().SetFullDocument(options.UpdateLookup))
 		if err != nil {
 			// Call fatal only after the last retry otherwise, report error on continue retyring
 			if retries <= 1 {
@@ -236,6 +333,8 @@ func watchClusterDB(cDB *mongo.Database) {
 
 	// Whenever there is a new change event, decode the event and process  it
 	for cs.Next(context.TODO()) {
+		// The change stays with us till the API server is back
+		waitKubeApi()
 		var changeEvent bson.M
 
 		err = cs.Decode(&changeEvent)
@@ -251,73 +350,89 @@ func watchClusterDB(cDB *mongo.Database) {
 		ns := changeEvent["ns"].(primitive.M)
 		coll := ns["coll"].(string)
 
-		switch coll {
-		case "NxtTenants":
-			dKey := changeEvent["documentKey"].(primitive.M)
-			tenant := dKey["_id"].(string)
-			var clcfg *ClusterConfig
-			var err error
-			errMsg := fnLine()
+		// The tenants are worked on with the eLock held, same as the error retries
+		eLock.Lock()
+		tenant, connector, errMsg, err := processChange(op, coll, changeEvent)
+		eLock.Unlock()
+		addError(err, errMsg, op, coll, tenant, connector)
+		if err = cs.Err(); err != nil {
+			glog.Fatalf("Watch MongoDB Change notification disconnected. %v", err)
+		}
+	}
+}
+
+// Work on one change in the cluster DB, returns whom the change was for and how it went
+func processChange(op string, coll string, changeEvent bson.M) (string, string, string, error) {
+	switch coll {
+	case "NxtTenants":
+		dKey := changeEvent["documentKey"].(primitive.M)
+		tenant := dKey["_id"].(string)
+		var clcfg *ClusterConfig
+		var err error
+		errMsg := fnLine()
+		observeStatus(tenant, "", op)
+		switch op {
+		case "insert":
+			err, clcfg = DBFindTenantInCluster(tenant)
+			if err == nil {
+				errMsg, err = addNewTenant(clcfg)
+			}
+		case "delete":
+			errMsg, err = deleteNamespace(tenant, tenants[tenant])
+		case "update":
+			err, clcfg = DBFindTenantInCluster(tenant)
+			if err == nil {
+				errMsg, err = updateAgents(clcfg)
+			}
+		}
+		recordEvent(tenant, "", coll, op, err, errMsg)
+		opStatus(tenant, "", op, err, errMsg)
+		glog.Infof("%s Tenant - %s %v %v clcfg:%v", op, tenant, err, errMsg, clcfg)
+		return tenant, "", errMsg, err
+
+	case "NxtConnectors":
+		connector := ""
+		tenant := ""
+		var clcfg *ClusterConfig
+		var err error
+		errMsg := fnLine()
+		for key, val := range changeEvent["documentKey"].(primitive.M) {
+			if key == "_id" {
+				split := strings.Split(val.(string), ":")
+				tenant = split[0]
+				connector = val.(string)
+				break
+			}
+		}
+
+		observeStatus(tenant, connector, op)
+		err, clcfg = DBFindTenantInCluster(tenant)
+		if err == nil {
 			switch op {
 			case "insert":
-				err, clcfg = DBFindTenantInCluster(tenant)
-				if err == nil {
-					errMsg, err = addNewTenant(clcfg)
+				if clcfg != nil {
+					errMsg, err = createConnectors(clcfg)
 				}
 			case "delete":
-				errMsg, err = deleteNamespace(tenant, tenants[tenant])
+				errMsg, err = deleteConnector(tenant, connector)
 			case "update":
-				err, clcfg = DBFindTenantInCluster(tenant)
-				if err == nil {
-					errMsg, err = updateAgents(clcfg)
-				}
-			}
-			addError(err, errMsg, op, coll, tenant, "")
-			glog.Infof("%s Tenant - %s %v %v clcfg:%v", op, tenant, err, errMsg, clcfg)
-
-		case "NxtConnectors":
-			connector := ""
-			tenant := ""
-			var clcfg *ClusterConfig
-			var err error
-			errMsg := fnLine()
-			for key, val := range changeEvent["documentKey"].(primitive.M) {
-				if key == "_id" {
-					split := strings.Split(val.(string), ":")
-					tenant = split[0]
-					connector = val.(string)
-					break
-				}
-			}
-
-			err, clcfg = DBFindTenantInCluster(tenant)
-			if err == nil {
-				switch op {
-				case "insert":
-					if clcfg != nil {
-						errMsg, err = createConnectors(clcfg)
-					}
-				case "delete":
-					errMsg, err = deleteConnector(tenant, connector)
-				case "update":
-					if clcfg != nil {
-						errMsg, err = createConnectors(clcfg)
-					}
+				if clcfg != nil {
+					errMsg, err = createConnectors(clcfg)
 				}
 			}
-			addError(err, errMsg, op, coll, tenant, connector)
-			glog.Info(op, " connector - ", connector, " to tenant - ", tenant, " err:", err, " clcfg:", clcfg, " ", errMsg)
-
-		case "NxtGateways":
-			// TODO: Gateways don't handle delete as of today
-			errMsg, err := createEgressGateways()
-			addError(err, errMsg, op, coll, "", "")
-			glog.Info("Egress Gateway - ", op, err, errMsg)
-		}
-		if err = cs.Err(); err != nil {
-			glog.Fatalf("Watch MongoDB Change notification disconnected. %v", err)
 		}
-	}
+		recordEvent(tenant, connector, coll, op, err, errMsg)
+		opStatus(tenant, connector, op, err, errMsg)
+		glog.Info(op, " connector - ", connector, " to tenant - ", tenant, " err:", err, " clcfg:", clcfg, " ", errMsg)
+		return tenant, connector, errMsg, err
+
+	case "NxtGateways":
+		// TODO: Gateways don't handle delete as of today
+		errMsg, err := createEgressGateways()
+		glog.Info("Egress Gateway - ", op, err, errMsg)
+		return "", "", errMsg, err
+	}
+	return "", "", "", nil
 }
 
 func addNewTenant(clcfg *ClusterConfig) (string, error) {
@@ -344,16 +459,23 @@ func addNewTenant(clcfg *ClusterConfig) (string, error) {
 func deleteConnector(tenant string, id string) (string, error) {
 	t := tenants[tenant]
 	if t == nil {
-		return fnLine(), errors.New("Tenant not found")
+		// The tenant delete removes all its connectors, so a connector delete
+		// that shows up after the tenant is gone has nothing left to do
+		return "", nil
 	}
 	for i, c := range t.tenantSummary.Connectors {
 		if c.Id == id {
+			errMsg, err := drainConnector(tenant, t, &t.tenantSummary.Connectors[i])
+			if err != nil {
+				return errMsg, err
+			}
+			c = t.tenantSummary.Connectors[i]
 			// First delete from kubectl and THEN update the summary database that then
 			// entry has been deleted, so that if we crash in the midst of a delete, we
 			// will still continue attempting a delete when we come back up next time.
 			// Trying to delete non existant stuff will return a NotFound and we handle that
 			// gracefully
-			errMsg, err := deleteOneConnector(tenant, c.Connectid, &c)
+			errMsg, err = deleteOneConnector(tenant, c.Connectid, &c)
 			if err != nil {
 				return errMsg, err
 			}
@@ -375,12 +497,17 @@ func deleteConnector(tenant string, id string) (string, error) {
 
 func updateAgents(clcfg *ClusterConfig) (string, error) {
 	t := tenants[clcfg.Tenant]
-	errMsg, err := createAgentDeployments(clcfg)
+	errMsg, err := updateNamespace(clcfg)
+	if err != nil {
+		return errMsg, err
+	}
+	errMsg, err = createAgentDeployments(clcfg)
 	if err != nil {
 		return errMsg, err
 	}
 	t.deployVersion = clcfg.Version
-	return "", nil
+	// The tenant config decides the image of the cpods too (canary or not)
+	return createConnectors(clcfg)
 }
 
 func makeTenantInfo(tenant string) *tenantInfo {
@@ -409,45 +536,371 @@ func getGwName(cluster string) string {
 	return cluster + ".nextensio.net"
 }
 
-func checkKubeHardErr(errStr string) {
+//-----------------------------------Kube API health---------------------------------
+
+// The health of our connection to the kubernetes API server. While the API is down,
+// the work queues (db watch, error retries and the background processes) wait for it
+// to come back rather than piling up failures. Nobody waits while holding the eLock
+type kubeApiHealth struct {
+	lock       sync.Mutex
+	cond       *sync.Cond
+	up         bool
+	changeAt   time.Time
+	lastErr    string
+	probes     int
+	probeFails int
+	downs      int
+	wake       chan bool
+}
+
+var kubeApi = newKubeApiHealth()
+
+func newKubeApiHealth() *kubeApiHealth {
+	h := &kubeApiHealth{up: true, changeAt: time.Now(), wake: make(chan bool, 1)}
+	h.cond = sync.NewCond(&h.lock)
+	return h
+}
+
+// A kubectl command failed, if it looks like the API server itself is in trouble, ask
+// the monitor to check it. This never blocks, the caller just fails and the failure
+// is retried like any other once the API is back
+func kickKubeApi(errStr string) {
 	if strings.Contains(errStr, "The connection to the server") ||
 		strings.Contains(errStr, "You must be logged in to the server") ||
 		strings.Contains(errStr, "error loading config file") {
-		glog.Infof("Kube hard error encountered...")
-		for { // Sit in a loop until the error is cleared
-			cmd := exec.Command("kubectl", "get", "pod")
-			_, err := cmd.CombinedOutput()
-			if err == nil {
-				glog.Infof("kube hard error -- cleared")
-				break
+		select {
+		case kubeApi.wake <- true:
+		default:
+		}
+	}
+}
+
+// Wait till the API server is reachable, must NOT be called with the eLock held
+func waitKubeApi() {
+	kubeApi.lock.Lock()
+	for !kubeApi.up {
+		kubeApi.cond.Wait()
+	}
+	kubeApi.lock.Unlock()
+}
+
+func probeKubeApi() error {
+	cmd := exec.Command("kubectl", "get", "--raw", "/readyz")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.New(strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func setKubeApi(err error) {
+	kubeApi.lock.Lock()
+	defer kubeApi.lock.Unlock()
+	kubeApi.probes++
+	up := err == nil
+	if !up {
+		kubeApi.probeFails++
+		kubeApi.lastErr = err.Error()
+	}
+	if up == kubeApi.up {
+		return
+	}
+	kubeApi.up = up
+	kubeApi.changeAt = time.Now()
+	if up {
+		glog.Info("Kube API is back, resuming work")
+		kubeApi.cond.Broadcast()
+	} else {
+		kubeApi.downs++
+		glog.Error("Kube API is down, pausing work: ", kubeApi.lastErr)
+	}
+}
+
+// Probe the API server every once in a while, or right away when a kubectl failure
+// hints at trouble. While its down, keep probing with a backoff
+func kubeApiMonitor() {
+	backoff := time.Second
+	for {
+		kubeApi.lock.Lock()
+		up := kubeApi.up
+		kubeApi.lock.Unlock()
+		if up {
+			select {
+			case <-kubeApi.wake:
+			case <-time.After(30 * time.Second):
+			}
+		} else {
+			time.Sleep(backoff)
+		}
+		err := probeKubeApi()
+		setKubeApi(err)
+		if err != nil {
+			backoff *= 2
+			if backoff > 30*time.Second {
+				backoff = 30 * time.Second
 			}
-			time.Sleep(2 * time.Second)
+		} else {
+			backoff = time.Second
 		}
 	}
 }
 
-func kubectlApply(file string) error {
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	kubeApi.lock.Lock()
+	defer kubeApi.lock.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP mel_kube_api_up Whether the kubernetes API server is reachable\n")
+	fmt.Fprintf(w, "# TYPE mel_kube_api_up gauge\n")
+	fmt.Fprintf(w, "mel_kube_api_up %d\n", boolToInt(kubeApi.up))
+	fmt.Fprintf(w, "# HELP mel_kube_api_change_time_seconds When the API server last went up or down\n")
+	fmt.Fprintf(w, "# TYPE mel_kube_api_change_time_seconds gauge\n")
+	fmt.Fprintf(w, "mel_kube_api_change_time_seconds %d\n", kubeApi.changeAt.Unix())
+	fmt.Fprintf(w, "# HELP mel_kube_api_probes_total Probes of the API server\n")
+	fmt.Fprintf(w, "# TYPE mel_kube_api_probes_total counter\n")
+	fmt.Fprintf(w, "mel_kube_api_probes_total %d\n", kubeApi.probes)
+	fmt.Fprintf(w, "# HELP mel_kube_api_probe_failures_total Probes of the API server that failed\n")
+	fmt.Fprintf(w, "# TYPE mel_kube_api_probe_failures_total counter\n")
+	fmt.Fprintf(w, "mel_kube_api_probe_failures_total %d\n", kubeApi.probeFails)
+	fmt.Fprintf(w, "# HELP mel_kube_api_downs_total Times the API server went down\n")
+	fmt.Fprintf(w, "# TYPE mel_kube_api_downs_total counter\n")
+	fmt.Fprintf(w, "mel_kube_api_downs_total %d\n", kubeApi.downs)
+}
+
+type kubeApiStatus struct {
+	Up       bool   `json:"up"`
+	ChangeAt string `json:"changeat"`
+	LastErr  string `json:"lasterror"`
+	Paused   bool   `json:"paused"`
+}
+
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	kubeApi.lock.Lock()
+	status := kubeApiStatus{
+		Up: kubeApi.up, ChangeAt: kubeApi.changeAt.Format(time.RFC1123),
+		LastErr: kubeApi.lastErr, Paused: !kubeApi.up,
+	}
+	kubeApi.lock.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Up {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]kubeApiStatus{"kubeapi": status})
+}
+
+func statusServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/status", statusHandler)
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		glog.Error("Status server on ", addr, " failed: ", err)
+	}
+}
+
+func kubectlApply(mf *manifest) error {
+	_, _, err := kubectlApplyOut(mf)
+	return err
+}
+
+// Apply and also return the names of the objects applied, one per line, and the
+// errors kubectl had (which can span many lines) as they are
+func kubectlApplyOut(mf *manifest) (string, string, error) {
 	if unitTesting {
 		kubeErr := GetEnv("TEST_KUBE_ERR", "NOT_TEST")
 		if kubeErr == "true" {
 			glog.Error("KubeApply UT error")
-			return errors.New("Kubernetes unit test error")
+			return "", "", errors.New("Kubernetes unit test error")
 		}
-		return nil
-	}
-	cmd := exec.Command("kubectl", "apply", "-f", file)
-	out, err := cmd.CombinedOutput()
-	glog.Error("kubectl apply ", file, " result: ", string(out))
+		return "", "", nil
+	}
+	args := []string{"apply", "--server-side", "--field-manager=" + fieldManager, "-o", "name", "-f", "-"}
+	force := applyForce(mf)
+	if force {
+		args = append(args, "--force-conflicts")
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("kubectl", args...)
+	cmd.Stdin = strings.NewReader(mf.yaml)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	names, errOut := stdout.String(), stderr.String()
 	if err != nil {
-		checkKubeHardErr(string(out))
-		glog.Error("kubectl apply ", file, " failed: ", string(out), " error: ", err)
-		return err
+		kickKubeApi(errOut)
+		glog.Error("kubectl apply ", mf.name, " failed: ", errOut, " error: ", err)
+		if strings.Contains(errOut, "exceeded quota") {
+			return names, errOut, fmt.Errorf("%w: %s", errQuotaExceeded, errOut)
+		}
+		if !force && applyConflict(args, mf) {
+			return names, errOut, fmt.Errorf("%w: %s", errApplyConflict, errOut)
+		}
+		return names, errOut, err
+	}
+	if errOut != "" {
+		// Warnings like deprecated apis, the apply went through
+		glog.Warning("kubectl apply ", mf.name, ": ", errOut)
 	}
+	glog.Info("kubectl apply ", mf.name, " result: ", names)
 
-	return nil
+	return names, "", nil
+}
+
+// Forcing conflicts is all that --force-conflicts changes, so if a failed apply goes
+// through with it (as a server side dry run), it failed because of the conflicts
+func applyConflict(args []string, mf *manifest) bool {
+	args = append(append([]string{}, args...), "--force-conflicts", "--dry-run=server")
+	cmd := exec.Command("kubectl", args...)
+	cmd.Stdin = strings.NewReader(mf.yaml)
+	return cmd.Run() == nil
+}
+
+//-----------------------------------Batch apply-----------------------------------
+
+// The order in which kinds are applied within a batch, the things that others refer
+// to go first. Kinds not listed here go last
+var applyOrder = []string{
+	"Namespace", "ServiceAccount", "ConfigMap", "Secret", "Service",
+	"StatefulSet", "Deployment", "DaemonSet", "HorizontalPodAutoscaler",
+	"DestinationRule", "ServiceEntry", "VirtualService", "Gateway", "EnvoyFilter",
+}
+
+func applyRank(mf *manifest) int {
+	kinds := manifestKinds(mf)
+	if len(kinds) == 0 {
+		return len(applyOrder)
+	}
+	for i, k := range applyOrder {
+		if k == kinds[0] {
+			return i
+		}
+	}
+	return len(applyOrder)
+}
+
+// How one object in a batch apply went
+type applyResult struct {
+	Object string
+	Result string
+	Failed bool
+}
+
+// The objects of a connector or an apod set, applied with one kubectl apply
+type applyBatch struct {
+	tenant    string
+	name      string
+	manifests []*manifest
+	results   []applyResult
+}
+
+func newApplyBatch(tenant string, name string) *applyBatch {
+	return &applyBatch{tenant: tenant, name: name}
+}
+
+// Add a generated manifest to the batch
+func (b *applyBatch) add(mf *manifest) {
+	b.manifests = append(b.manifests, mf)
+}
+
+// With -o name kubectl prints just the "<kind>/<name>" of each object applied, the
+// errors are on stderr and are kept together, a message can run over many lines
+func applyResults(names string, errOut string) []applyResult {
+	var results []applyResult
+	for _, line := range strings.Split(names, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			results = append(results, applyResult{Object: line, Result: "applied"})
+		}
+	}
+	errOut = strings.TrimSpace(errOut)
+	if errOut != "" {
+		results = append(results, applyResult{Result: errOut, Failed: true})
+	}
+	return results
+}
+
+// Apply all the manifests in the batch as multi document yamls, in the dependency
+// order of their kinds. Forcing conflicts is decided per kubectl apply, so the kinds
+// we are asked to force go in their own apply and dont take the others along. The
+// result of each object is in b.results, and the ones that failed are in the error
+func (b *applyBatch) apply() error {
+	sort.SliceStable(b.manifests, func(i, j int) bool {
+		return applyRank(b.manifests[i]) < applyRank(b.manifests[j])
+	})
+	var applyErr error
+	b.results = nil
+	for start := 0; start < len(b.manifests); {
+		force := applyForce(b.manifests[start])
+		end := start + 1
+		for end < len(b.manifests) && applyForce(b.manifests[end]) == force {
+			end++
+		}
+		var docs []string
+		for _, mf := range b.manifests[start:end] {
+			docs = append(docs, strings.TrimSuffix(mf.yaml, "\n"))
+		}
+		name := b.tenant + "/" + b.name + "-batch.yaml"
+		if force {
+			name = b.tenant + "/" + b.name + "-batch-force.yaml"
+		}
+		names, errOut, err := kubectlApplyOut(&manifest{name: name, yaml: strings.Join(docs, "\n---\n") + "\n"})
+		if err != nil && applyErr == nil {
+			applyErr = err
+		}
+		b.results = append(b.results, applyResults(names, errOut)...)
+		start = end
+	}
+	var failed []string
+	for _, r := range b.results {
+		if r.Failed {
+			glog.Error("Batch ", b.name, ": ", r.Result)
+			failed = append(failed, r.Result)
+		} else {
+			glog.Info("Batch ", b.name, ": ", r.Object, " ", r.Result)
+		}
+	}
+	if len(failed) == 0 {
+		return applyErr
+	}
+	if applyErr == nil {
+		applyErr = errors.New("batch apply failed")
+	}
+	return fmt.Errorf("%w: %s", applyErr, strings.Join(failed, "; "))
+}
+
+// The kinds of the resources in a yaml (or json) manifest
+func manifestKinds(mf *manifest) []string {
+	var kinds []string
+	re := regexp.MustCompile(`(?m)^kind:\s*(\S+)|"kind":\s*"([^"]+)"`)
+	for _, m := range re.FindAllStringSubmatch(mf.yaml, -1) {
+		kinds = append(kinds, m[1]+m[2])
+	}
+	return kinds
+}
+
+// Take over fields owned by other field managers if the manifest has any of the
+// kinds we are asked to force
+func applyForce(mf *manifest) bool {
+	if len(ApplyForceKinds) == 0 {
+		return false
+	}
+	for _, k := range manifestKinds(mf) {
+		for _, f := range ApplyForceKinds {
+			if k == f {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-func kubectlDelete(file string) (string, error) {
+func kubectlDelete(mf *manifest) (string, error) {
 	if unitTesting {
 		kubeErr := GetEnv("TEST_KUBE_ERR", "NOT_TEST")
 		if kubeErr == "true" {
@@ -456,233 +909,373 @@ func kubectlDelete(file string) (string, error) {
 		}
 		return "", nil
 	}
-	cmd := exec.Command("kubectl", "delete", "-f", file)
+	cmd := exec.Command("kubectl", "delete", "-f", "-")
+	cmd.Stdin = strings.NewReader(mf.yaml)
 	out, err := cmd.CombinedOutput()
-	glog.Error("kubectl delete ", file, " result: ", string(out))
 	if err != nil {
-		checkKubeHardErr(string(out))
-		glog.Error("kubectl delete ", file, " failed: ", string(out), " error: ", err)
+		kickKubeApi(string(out))
+		glog.Error("kubectl delete ", mf.name, " failed: ", string(out), " error: ", err)
 		return string(out), err
 	}
+	glog.Info("kubectl delete ", mf.name, " result: ", string(out))
 
 	return "", nil
 }
 
-func yamlFile(file string, yaml string) string {
-	f, err := os.Create(file)
-	if err != nil {
-		glog.Error("Cannot open yaml ", file)
-		return ""
+//-------------------------------------Manifests-------------------------------------
+
+// A rendered yaml, fed to kubectl on its stdin. The name is where its written
+// under the debug directory (if one is configured), like <tenant>/deploy-<pod>.yaml
+type manifest struct {
+	name string
+	yaml string
+}
+
+// Manifests are kept in memory, and written out only if there is a debug
+// directory to look at them in
+func renderManifest(name string, yaml string) *manifest {
+	mf := &manifest{name: name, yaml: yaml}
+	if DebugDir == "" {
+		return mf
+	}
+	file := filepath.Join(DebugDir, name)
+	err := os.MkdirAll(filepath.Dir(file), 0777)
+	if err == nil {
+		err = ioutil.WriteFile(file, []byte(yaml), 0666)
 	}
-	defer f.Close()
-	_, err = io.WriteString(f, yaml)
 	if err != nil {
-		glog.Error("Cannot write yaml ", file)
-		return ""
+		// Its just for debugging, dont fail because of it
+		glog.Error("Cannot write debug yaml ", file, ": ", err)
+	}
+	return mf
+}
+
+// The objects are gone, so is the debug copy of the manifest
+func (mf *manifest) discard() {
+	if mf != nil && DebugDir != "" {
+		os.Remove(filepath.Join(DebugDir, mf.name))
+	}
+}
+
+// Every object mel creates is labelled with who owns it, so that the garbage
+// collector can find the objects that dont belong to anything anymore. The
+// tenant/connector/apodset are left out if empty, and replica if negative
+const (
+	labelManagedBy = "app.kubernetes.io/managed-by"
+	labelTenant    = "nextensio.io/tenant"
+	labelConnector = "nextensio.io/connector"
+	labelApodSet   = "nextensio.io/apodset"
+	labelReplica   = "nextensio.io/replica"
+)
+
+func ownerLabels(tenant string, connector string, apodset string, replica int) map[string]string {
+	labels := map[string]string{labelManagedBy: "mel"}
+	if tenant != "" {
+		labels[labelTenant] = tenant
+	}
+	if connector != "" {
+		labels[labelConnector] = connector
+	}
+	if apodset != "" {
+		labels[labelApodSet] = apodset
 	}
-	f.Sync()
-	return file
+	if replica >= 0 {
+		labels[labelReplica] = strconv.Itoa(replica)
+	}
+	return labels
 }
 
 // Generate envoy flow control settings per tenant
-func generateTenantFlowControl(t string) string {
-	file := "/tmp/" + t + "/flow_control.yaml"
+func generateTenantFlowControl(t string) *manifest {
+	name := t + "/flow_control.yaml"
 	yaml := GetFlowControl(t)
-	return yamlFile(file, yaml)
+	yaml = AddOwnerLabels(yaml, ownerLabels(t, "", "", -1))
+	return renderManifest(name, yaml)
+}
+
+// Generate the network policies that isolate the tenant from other tenants
+func generateTenantNetPolicy(t string) *manifest {
+	name := t + "/netpolicy.yaml"
+	yaml := GetNetworkPolicy(t)
+	yaml = AddOwnerLabels(yaml, ownerLabels(t, "", "", -1))
+	return renderManifest(name, yaml)
+}
+
+// Generate the istio mTLS and authorization policies for the tenant
+func generateTenantAuthz(t string) *manifest {
+	name := t + "/authz.yaml"
+	yaml := GetTenantAuthz(t, IngressPrincipal)
+	yaml = AddOwnerLabels(yaml, ownerLabels(t, "", "", -1))
+	return renderManifest(name, yaml)
+}
+
+// Generate the secret holding the endpoints (and their credentials) the tenant pods need
+func generateTenantSecret(t string) *manifest {
+	name := t + "/secret.yaml"
+	yaml := GetTenantSecret(t, MyMongo, MyJaeger)
+	yaml = AddOwnerLabels(yaml, ownerLabels(t, "", "", -1))
+	return renderManifest(name, yaml)
+}
+
+// The pods carry the version of the endpoints secret, it goes up whenever the secret
+// contents change (mel restarted with new endpoints) so that the pods get rolled
+func secretVersion(tenant string) int {
+	t := tenants[tenant]
+	if t == nil {
+		return 0
+	}
+	return t.tenantSummary.SecretVersion
+}
+
+func createTenantSecret(tenant string) error {
+	t := tenants[tenant]
+	yaml := GetTenantSecret(tenant, MyMongo, MyJaeger)
+	h := fnv.New32a()
+	h.Write([]byte(yaml))
+	hash := fmt.Sprintf("%x", h.Sum32())
+	if t.tenantSummary.SecretHash != hash {
+		// Update the summary first, if we crash before the pods are redeployed we will
+		// still have the new version when we come back
+		t.tenantSummary.Tenant = tenant
+		t.tenantSummary.SecretHash = hash
+		t.tenantSummary.SecretVersion++
+		err := DBUpdateTenantSummary(tenant, t.tenantSummary)
+		if err != nil {
+			t.tenantSummary.SecretVersion--
+			t.tenantSummary.SecretHash = ""
+			return err
+		}
+	}
+	mf := generateTenantSecret(tenant)
+	return kubectlApply(mf)
+}
+
+func renderRouteReflector(ct *ClusterConfig) string {
+	replicas := ct.RRRepl
+	if replicas <= 0 {
+		replicas = 1
+	}
+	yaml := GetRouteReflector(ct.Tenant, MyCluster, ct.RRImage, replicas, secretVersion(ct.Tenant), &ct.RRResources)
+	return AddOwnerLabels(yaml, ownerLabels(ct.Tenant, "", "", -1))
 }
 
 // Generate route-reflector yaml for the  tenant
-func generateTenantRouteReflector(t string) string {
-	file := "/tmp/" + t + "/route_reflector.yaml"
-	yaml := GetRouteReflector(t, MyCluster, MyMongo)
-	return yamlFile(file, yaml)
+func generateTenantRouteReflector(ct *ClusterConfig) *manifest {
+	name := ct.Tenant + "/route_reflector.yaml"
+	return renderManifest(name, renderRouteReflector(ct))
+}
+
+// The route reflector is re-applied (and hence rolled) only when its yaml changes,
+// the version applied is the hash of the yaml
+func updateRouteReflector(ct *ClusterConfig) (string, error) {
+	summary := tenants[ct.Tenant].tenantSummary
+	h := fnv.New32a()
+	h.Write([]byte(renderRouteReflector(ct)))
+	version := fmt.Sprintf("%x", h.Sum32())
+	if summary.RRVersion == version {
+		return "", nil
+	}
+	mf := generateTenantRouteReflector(ct)
+	err := kubectlApply(mf)
+	if err != nil {
+		return fnLine(), err
+	}
+	// The version is recorded only once its applied, so a failed apply is tried again
+	old := summary.RRVersion
+	summary.Tenant = ct.Tenant
+	summary.RRVersion = version
+	err = DBUpdateTenantSummary(ct.Tenant, summary)
+	if err != nil {
+		summary.RRVersion = old
+		return fnLine(), err
+	}
+	glog.Info("Route reflector of ", ct.Tenant, " at version ", version)
+	return "", nil
 }
 
 // Generate virtual service to handle Cpod to Apod traffic based on x-nextensio-for
 // header whose value is a pod name
-func generateNxtForApod(t string, podname string, idx int) string {
+func generateNxtForApod(t string, podname string, idx int) *manifest {
 	hostname := podname + fmt.Sprintf("-%d", idx)
-	file := "/tmp/" + t + "/nxtfor-" + hostname + ".yaml"
+	name := t + "/nxtfor-" + hostname + ".yaml"
 	yaml := GetNxtForApodService(t, getGwName(MyCluster), podname, hostname)
-	return yamlFile(file, yaml)
+	yaml = AddOwnerLabels(yaml, ownerLabels(t, "", podname, idx))
+	return renderManifest(name, yaml)
 }
 
-func createNxtForApod(t string, podname string, replicas int) error {
-	var err error
-	var file string
+func addNxtForApod(batch *applyBatch, t string, podname string, replicas int) {
 	for i := 0; i < replicas; i++ {
 		// Repeat for each replica
-		file = generateNxtForApod(t, podname, i)
-		if file == "" {
-			err = errors.New("yaml fail")
-		} else {
-			err1 := kubectlApply(file)
-			if err1 != nil {
-				err = err1
-			}
-		}
+		batch.add(generateNxtForApod(t, podname, i))
 	}
-	return err
 }
 
 func deleteNxtForApod(t string, podname string, replicaStart int, replicaEnd int) error {
-	var file string
+	var mf *manifest
 	for i := replicaStart; i < replicaEnd; i++ {
 		// Repeat for each replica
-		file = generateNxtForApod(t, podname, i)
-		if file == "" {
-			return errors.New("yaml fail")
-		} else {
-			out, err := kubectlDelete(file)
-			if err != nil && !strings.Contains(out, "NotFound") {
-				return err
-			}
-			os.Remove(file)
+		mf = generateNxtForApod(t, podname, i)
+		out, err := kubectlDelete(mf)
+		if err != nil && !strings.Contains(out, "NotFound") {
+			return err
 		}
+		mf.discard()
 	}
 	return nil
 }
 
 // Generate virtual service to handle user connections into an Apod based
 // on x-nextensio-connect header whose value is a pod name
-func generateApodNxtConnect(t string, podname string) string {
-	file := "/tmp/" + t + "/nxtconnect-" + podname + ".yaml"
+func generateApodNxtConnect(t string, podname string) *manifest {
+	name := t + "/nxtconnect-" + podname + ".yaml"
 	yaml := GetApodConnectService(t, getGwName(MyCluster), podname)
-	return yamlFile(file, yaml)
+	yaml = AddOwnerLabels(yaml, ownerLabels(t, "", podname, -1))
+	return renderManifest(name, yaml)
 }
 
 func createApodNxtConnect(tenant string, podname string) error {
-	file := generateApodNxtConnect(tenant, podname)
-	if file == "" {
-		return errors.New("yaml fail")
-	}
-	return kubectlApply(file)
+	mf := generateApodNxtConnect(tenant, podname)
+	return kubectlApply(mf)
 }
 
 func deleteApodNxtConnect(tenant string, podname string) error {
-	file := generateApodNxtConnect(tenant, podname)
-	if file == "" {
-		return errors.New("yaml fail")
-	}
-	out, err := kubectlDelete(file)
+	mf := generateApodNxtConnect(tenant, podname)
+	out, err := kubectlDelete(mf)
 	if err != nil && !strings.Contains(out, "NotFound") {
 		return err
 	}
-	os.Remove(file)
+	mf.discard()
 	return nil
 }
 
-// Generate StatefulSet deployment for Apod
-func generateApodDeploy(tenant string, image string, podname string, replicas int) string {
-	file := "/tmp/" + tenant + "/deploy-" + podname + ".yaml"
-	yaml := GetApodDeploy(tenant, image, MyMongo, MyJaeger, podname, MyCluster, replicas)
-	return yamlFile(file, yaml)
+// Generate StatefulSet deployment for Apod, a negative replicas leaves the
+// replica count out of the StatefulSet
+func generateApodDeploy(tenant string, image string, podname string, replicas int) *manifest {
+	name := tenant + "/deploy-" + podname + ".yaml"
+	yaml := GetApodDeploy(tenant, image, podname, MyCluster, replicas, secretVersion(tenant))
+	yaml = AddOwnerLabels(yaml, ownerLabels(tenant, "", podname, -1))
+	return renderManifest(name, yaml)
+}
+
+// Generate HorizontalPodAutoscaler for an Apod StatefulSet
+func generateApodHpa(ct *ClusterConfig, podname string) *manifest {
+	name := ct.Tenant + "/hpa-" + podname + ".yaml"
+	cpu := ct.ApodCpuTarget
+	if cpu <= 0 {
+		cpu = 80
+	}
+	yaml := GetApodHpa(ct.Tenant, podname, apodMinRepl(ct), ct.ApodMaxRepl, cpu)
+	yaml = AddOwnerLabels(yaml, ownerLabels(ct.Tenant, "", podname, -1))
+	return renderManifest(name, yaml)
+}
+
+func addApodHpa(batch *applyBatch, ct *ClusterConfig, podname string) {
+	batch.add(generateApodHpa(ct, podname))
+}
+
+// Deleting just needs the name, so the config here need not be the same one
+// the hpa was created with
+func deleteApodHpa(tenant string, podname string) error {
+	ct := ClusterConfig{Tenant: tenant, ApodMaxRepl: 1}
+	mf := generateApodHpa(&ct, podname)
+	out, err := kubectlDelete(mf)
+	if err != nil && !strings.Contains(out, "NotFound") {
+		return err
+	}
+	mf.discard()
+	return nil
 }
 
 // Generate StatefulSet deployment for Cpod
-func generateCpodDeploy(tenant string, image string, podname string, replicas int) string {
-	file := "/tmp/" + tenant + "/deploy-" + podname + ".yaml"
-	yaml := GetCpodDeploy(tenant, image, MyMongo, MyJaeger, podname, MyCluster, replicas)
-	return yamlFile(file, yaml)
+func generateCpodDeploy(tenant string, image string, podname string, replicas int, res *PodResources) *manifest {
+	name := tenant + "/deploy-" + podname + ".yaml"
+	yaml := GetCpodDeploy(tenant, image, podname, MyCluster, replicas, secretVersion(tenant), res)
+	yaml = AddOwnerLabels(yaml, ownerLabels(tenant, podname, "", -1))
+	return renderManifest(name, yaml)
 }
 
 // Generate envoy flow control settings per tenant
-func generateCpodHealth(tenant string, podname string) string {
-	file := "/tmp/" + tenant + "/health-" + podname + ".yaml"
+func generateCpodHealth(tenant string, podname string) *manifest {
+	name := tenant + "/health-" + podname + ".yaml"
 	yaml := GetCpodHealth(tenant, podname)
-	return yamlFile(file, yaml)
+	yaml = AddOwnerLabels(yaml, ownerLabels(tenant, podname, "", -1))
+	return renderManifest(name, yaml)
 }
 
 // Generate envoy flow control settings per tenant
-func generateCpodHeadless(tenant string, podname string) string {
-	file := "/tmp/" + tenant + "/headless-" + podname + ".yaml"
+func generateCpodHeadless(tenant string, podname string) *manifest {
+	name := tenant + "/headless-" + podname + ".yaml"
 	yaml := GetCpodHeadless(tenant, podname)
-	return yamlFile(file, yaml)
+	yaml = AddOwnerLabels(yaml, ownerLabels(tenant, podname, "", -1))
+	return renderManifest(name, yaml)
 }
 
 // Generate envoy flow control settings per tenant
-func generateApodHeadless(tenant string, podname string) string {
-	file := "/tmp/" + tenant + "/headless-" + podname + ".yaml"
+func generateApodHeadless(tenant string, podname string) *manifest {
+	name := tenant + "/headless-" + podname + ".yaml"
 	yaml := GetApodHeadless(tenant, podname)
-	return yamlFile(file, yaml)
+	yaml = AddOwnerLabels(yaml, ownerLabels(tenant, "", podname, -1))
+	return renderManifest(name, yaml)
 }
 
 // Generate service for handling outside connections into an Apod
-func generateApodOutService(tenant string, podname string) string {
-	file := "/tmp/" + tenant + "/service-outside-" + podname + ".yaml"
+func generateApodOutService(tenant string, podname string) *manifest {
+	name := tenant + "/service-outside-" + podname + ".yaml"
 	yaml := GetApodOutService(tenant, podname)
-	return yamlFile(file, yaml)
+	yaml = AddOwnerLabels(yaml, ownerLabels(tenant, "", podname, -1))
+	return renderManifest(name, yaml)
 }
 
 // Generate service for inter-cluster traffic coming into an Apod
-func generateApodInService(tenant string, podname string, idx int) string {
+func generateApodInService(tenant string, podname string, idx int) *manifest {
 	hostname := podname + fmt.Sprintf("-%d", idx)
-	file := "/tmp/" + tenant + "/service-inside-" + hostname + ".yaml"
+	name := tenant + "/service-inside-" + hostname + ".yaml"
 	yaml := GetApodInService(tenant, podname, hostname)
-	return yamlFile(file, yaml)
+	yaml = AddOwnerLabels(yaml, ownerLabels(tenant, "", podname, idx))
+	return renderManifest(name, yaml)
 }
 
 // Generate service for  traffic coming into a Cpod from within the nextensio network
-func generateCpodInService(tenant string, podname string) string {
-	file := "/tmp/" + tenant + "/service-inside-" + podname + ".yaml"
+func generateCpodInService(tenant string, podname string) *manifest {
+	name := tenant + "/service-inside-" + podname + ".yaml"
 	yaml := GetCpodInService(tenant, podname)
-	return yamlFile(file, yaml)
+	yaml = AddOwnerLabels(yaml, ownerLabels(tenant, podname, "", -1))
+	return renderManifest(name, yaml)
 }
 
 // Generate service for  traffic coming into a Cpod from connectors
-func generateCpodOutService(tenant string, podname string) string {
-	file := "/tmp/" + tenant + "/service-outside-" + podname + ".yaml"
+func generateCpodOutService(tenant string, podname string) *manifest {
+	name := tenant + "/service-outside-" + podname + ".yaml"
 	yaml := GetCpodOutService(tenant, podname)
-	return yamlFile(file, yaml)
+	yaml = AddOwnerLabels(yaml, ownerLabels(tenant, podname, "", -1))
+	return renderManifest(name, yaml)
 }
 
-func createApodService(tenant string, podname string, replicas int) error {
-	var err error
-	var file string
-	file = generateApodOutService(tenant, podname)
-	if file == "" {
-		return errors.New("yaml fail")
-	}
-	err = kubectlApply(file)
-
+func addApodService(batch *applyBatch, tenant string, podname string, replicas int) {
+	batch.add(generateApodOutService(tenant, podname))
 	for i := 0; i < replicas; i++ {
 		// Repeat for each replica
-		file = generateApodInService(tenant, podname, i)
-		if file == "" {
-			err = errors.New("yaml fail")
-		} else {
-			err1 := kubectlApply(file)
-			if err1 != nil {
-				err = err1
-			}
-		}
+		batch.add(generateApodInService(tenant, podname, i))
 	}
-	return err
 }
 
 func deleteApodService(tenant string, podname string, replicaStart int, replicaEnd int, outside bool) error {
 	if outside {
-		file := generateCpodOutService(tenant, podname)
-		if file == "" {
-			return errors.New("yaml file")
-		}
-		out, err := kubectlDelete(file)
+		mf := generateCpodOutService(tenant, podname)
+		out, err := kubectlDelete(mf)
 		// clustermgr might have crashed while in here and come back up and now
 		// we might be trying to delete something thats already deleted, so dont
 		// panic in that case
 		if err != nil && !strings.Contains(out, "NotFound") {
 			return err
 		}
-		os.Remove(file)
+		mf.discard()
 	}
 
 	for i := replicaStart; i < replicaEnd; i++ {
 		// Repeat for each replica
-		file := generateApodInService(tenant, podname, i)
-		if file == "" {
-			return errors.New("yaml file")
-		}
-		out, err := kubectlDelete(file)
+		mf := generateApodInService(tenant, podname, i)
+		out, err := kubectlDelete(mf)
 		// clustermgr might have crashed while in here and come back up and now
 		// we might be trying to delete something thats already deleted, so dont
 		// panic in that case
@@ -690,34 +1283,295 @@ func deleteApodService(tenant string, podname string, replicaStart int, replicaE
 			glog.Error("Inside service del failed,", i)
 			return err
 		}
-		os.Remove(file)
+		mf.discard()
 	}
 	return nil
 }
 
+// The kubectl jsonpath output leaves out fields that are not set (like readyReplicas
+// when none are ready), so the fields are separated by | and missing ones read as 0.
+// With a partitioned rollout only updated of the replicas run the latest spec
+func statefulSetReady(namespace string, name string, replicas int, updated int) (bool, error) {
+	jpath := "jsonpath={.metadata.generation}|{.status.observedGeneration}|{.status.readyReplicas}|" +
+		"{.status.updatedReplicas}|{.status.currentRevision}|{.status.updateRevision}"
+	cmd := exec.Command("kubectl", "get", "statefulset", name, "-n", namespace, "-o", jpath)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		kickKubeApi(string(out))
+		return false, errors.New(string(out))
+	}
+	fields := strings.Split(string(out), "|")
+	if len(fields) != 6 {
+		return false, errors.New("Unexpected statefulset status: " + string(out))
+	}
+	var counts [4]int
+	for i := range counts {
+		counts[i], _ = strconv.Atoi(fields[i])
+	}
+	if counts[1] < counts[0] || counts[2] < replicas || counts[3] < updated {
+		return false, nil
+	}
+	return updated < replicas || fields[4] == fields[5], nil
+}
+
+// A StatefulSet as listed by kubectl, just the fields that say how far along it is
+type kubeStatefulSet struct {
+	Metadata struct {
+		Name       string `json:"name"`
+		Namespace  string `json:"namespace"`
+		Generation int64  `json:"generation"`
+	} `json:"metadata"`
+	Spec struct {
+		Replicas int `json:"replicas"`
+	} `json:"spec"`
+	Status struct {
+		ObservedGeneration int64  `json:"observedGeneration"`
+		ReadyReplicas      int    `json:"readyReplicas"`
+		UpdatedReplicas    int    `json:"updatedReplicas"`
+		CurrentRevision    string `json:"currentRevision"`
+		UpdateRevision     string `json:"updateRevision"`
+	} `json:"status"`
+}
+
+type kubeStatefulSetList struct {
+	Items []kubeStatefulSet `json:"items"`
+}
+
+// Same as statefulSetReady, for a listed StatefulSet
+func (ss *kubeStatefulSet) ready(replicas int) bool {
+	if ss.Status.ObservedGeneration < ss.Metadata.Generation {
+		return false
+	}
+	if ss.Status.ReadyReplicas < replicas || ss.Status.UpdatedReplicas < replicas {
+		return false
+	}
+	return ss.Status.CurrentRevision == ss.Status.UpdateRevision
+}
+
+// The StatefulSets as of the last listing keyed by namespace/name, worked on with the eLock held
+var statefulSets = make(map[string]*kubeStatefulSet)
+
+// List all the StatefulSets mel created in the tenant namespaces in one go, so that
+// the periodic checks dont have to get them one at a time
+func listStatefulSets() (map[string]*kubeStatefulSet, error) {
+	sets := make(map[string]*kubeStatefulSet)
+	if unitTesting {
+		return sets, nil
+	}
+	cmd := exec.Command("kubectl", "get", "statefulsets", "--all-namespaces", "-l", labelManagedBy+"=mel,"+labelTenant, "-o", "json")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		kickKubeApi(string(out))
+		return nil, errors.New(string(out))
+	}
+	var list kubeStatefulSetList
+	err = json.Unmarshal(out, &list)
+	if err != nil {
+		return nil, err
+	}
+	for i := range list.Items {
+		ss := &list.Items[i]
+		sets[ss.Metadata.Namespace+"/"+ss.Metadata.Name] = ss
+	}
+	return sets, nil
+}
+
+// Wait for all replicas of the StatefulSet to be ready, and updated of them to be
+// running the latest spec
+func waitStatefulSetReady(namespace string, name string, replicas int, updated int, timeout time.Duration) error {
+	if unitTesting {
+		kubeErr := GetEnv("TEST_KUBE_ERR", "NOT_TEST")
+		if kubeErr == "true" {
+			glog.Error("StatefulSet ready UT error")
+			return errors.New("Kubernetes unit test error")
+		}
+		return nil
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		ready, err := statefulSetReady(namespace, name, replicas, updated)
+		if ready {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return err
+			}
+			return errors.New("Timed out waiting for statefulset " + name + " to be ready")
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func daemonSetReady(namespace string, name string) (bool, error) {
+	jpath := "jsonpath={.metadata.generation}|{.status.observedGeneration}|{.status.desiredNumberScheduled}|" +
+		"{.status.numberReady}|{.status.updatedNumberScheduled}"
+	cmd := exec.Command("kubectl", "get", "daemonset", name, "-n", namespace, "-o", jpath)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		kickKubeApi(string(out))
+		return false, errors.New(string(out))
+	}
+	fields := strings.Split(string(out), "|")
+	if len(fields) != 5 {
+		return false, errors.New("Unexpected daemonset status: " + string(out))
+	}
+	var counts [5]int
+	for i := range counts {
+		counts[i], _ = strconv.Atoi(fields[i])
+	}
+	if counts[1] < counts[0] || counts[3] < counts[2] || counts[4] < counts[2] {
+		return false, nil
+	}
+	return true, nil
+}
+
+// Wait for all pods of the DaemonSet to be ready and running the latest spec
+func waitDaemonSetReady(namespace string, name string, timeout time.Duration) error {
+	if unitTesting {
+		kubeErr := GetEnv("TEST_KUBE_ERR", "NOT_TEST")
+		if kubeErr == "true" {
+			glog.Error("DaemonSet ready UT error")
+			return errors.New("Kubernetes unit test error")
+		}
+		return nil
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		ready, err := daemonSetReady(namespace, name)
+		if ready {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return err
+			}
+			return errors.New("Timed out waiting for daemonset " + name + " to be ready")
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func rolloutTimeout(ct *ClusterConfig) time.Duration {
+	if ct.RolloutTimeout <= 0 {
+		return 5 * time.Minute
+	}
+	return time.Duration(ct.RolloutTimeout) * time.Second
+}
+
+func apodMinRepl(ct *ClusterConfig) int {
+	if ct.ApodMinRepl <= 0 {
+		return 1
+	}
+	return ct.ApodMinRepl
+}
+
+// The number of replicas of an apod set that the summary knows of, with autoscaling
+// each set can be at a different count
+func summaryApodRepl(summary *TenantSummary, podname string) int {
+	if repl, ok := summary.ApodSetRepl[podname]; ok {
+		return repl
+	}
+	return summary.ApodRepl
+}
+
+// With autoscaling, we stay at whatever the HPA scaled the set to (as long as its
+// within the configured bounds) so that we dont keep fighting with the HPA
+func desiredApodRepl(ct *ClusterConfig, summary *TenantSummary, podname string) int {
+	if ct.ApodMaxRepl <= 0 {
+		return ct.ApodRepl
+	}
+	repl := summaryApodRepl(summary, podname)
+	if repl < apodMinRepl(ct) {
+		repl = apodMinRepl(ct)
+	}
+	if repl > ct.ApodMaxRepl {
+		repl = ct.ApodMaxRepl
+	}
+	return repl
+}
+
+func dynamicApodSets(ct *ClusterConfig) bool {
+	return ct.ApodSetsMax > ct.ApodSets && ct.ApodSetUsers > 0
+}
+
+// The configured ApodSets is the minimum number of sets when the sets are dynamic
+func desiredApodSets(ct *ClusterConfig, summary *TenantSummary) int {
+	if !dynamicApodSets(ct) {
+		return ct.ApodSets
+	}
+	sets := summary.ApodSetsDyn
+	if sets < ct.ApodSets {
+		sets = ct.ApodSets
+	}
+	if sets > ct.ApodSetsMax {
+		sets = ct.ApodSetsMax
+	}
+	return sets
+}
+
 func createAgentDeployments(ct *ClusterConfig) (string, error) {
 	t := tenants[ct.Tenant]
+	t.deployedAt = time.Now()
 	summary := t.tenantSummary
+	apodSets := desiredApodSets(ct, summary)
+	desired := make(map[string]int)
+	for i := 1; i <= apodSets; i++ {
+		podname := getApodSetName(ct.Tenant, i)
+		desired[podname] = desiredApodRepl(ct, summary, podname)
+	}
+
+	// In a rolling upgrade, the summary keeps the old image till ALL the apod sets
+	// are running the new one, so a set that fails can be reverted to the old image.
+	// The sets before RolloutSets are on the new image, the next one is moved to the
+	// new image and the readiness checks move on to the set after that once its ready.
+	// And if this image already failed once, dont keep trying it again and again,
+	// the sets stay on the old image and the rest of the config is still applied
+	image := ct.Image
+	if summary.Image != "" && summary.RolloutFailed == ct.Image {
+		image = summary.Image
+	}
+	rolling := ct.Rollout == "rolling" && summary.Image != "" && summary.Image != image
+	if rolling && summary.RolloutImage != image {
+		summary.RolloutImage = image
+		summary.RolloutSets = 0
+	}
+	if rolling && summary.RolloutSets >= apodSets {
+		// There are fewer sets now than when the rollout started, and all are done
+		rolling = false
+	}
 
 	// Delete not-needed resources first before appying the new resources
-	for i := 1; i <= ct.ApodSets; i++ {
+	for i := 1; i <= apodSets; i++ {
 		podname := getApodSetName(ct.Tenant, i)
-		err := deleteApodService(ct.Tenant, podname, ct.ApodRepl, summary.ApodRepl, false)
+		err := deleteApodService(ct.Tenant, podname, desired[podname], summaryApodRepl(summary, podname), false)
 		if err != nil {
 			return fnLine(), err
 		}
-		err = deleteNxtForApod(ct.Tenant, podname, ct.ApodRepl, summary.ApodRepl)
+		err = deleteNxtForApod(ct.Tenant, podname, desired[podname], summaryApodRepl(summary, podname))
 		if err != nil {
 			return fnLine(), err
 		}
+		if summary.ApodMaxRepl > 0 && ct.ApodMaxRepl <= 0 {
+			err = deleteApodHpa(ct.Tenant, podname)
+			if err != nil {
+				return fnLine(), err
+			}
+		}
 	}
-	for i := ct.ApodSets + 1; i <= summary.ApodSets; i++ {
+	for i := apodSets + 1; i <= summary.ApodSets; i++ {
 		podname := getApodSetName(ct.Tenant, i)
-		err := deleteApodService(ct.Tenant, podname, 0, summary.ApodRepl, true)
+		if summary.ApodMaxRepl > 0 {
+			err := deleteApodHpa(ct.Tenant, podname)
+			if err != nil {
+				return fnLine(), err
+			}
+		}
+		err := deleteApodService(ct.Tenant, podname, 0, summaryApodRepl(summary, podname), true)
 		if err != nil {
 			return fnLine(), err
 		}
-		err = deleteNxtForApod(ct.Tenant, podname, 0, summary.ApodRepl)
+		err = deleteNxtForApod(ct.Tenant, podname, 0, summaryApodRepl(summary, podname))
 		if err != nil {
 			return fnLine(), err
 		}
@@ -725,30 +1579,24 @@ func createAgentDeployments(ct *ClusterConfig) (string, error) {
 		if err != nil {
 			return fnLine(), err
 		}
-		file := generateApodHeadless(ct.Tenant, podname)
-		if file == "" {
-			return fnLine(), errors.New("cannot create headless file")
-		}
+		mf := generateApodHeadless(ct.Tenant, podname)
 		// clustermgr might have crashed while in here and come back up and now
 		// we might be trying to delete something thats already deleted, so dont
 		// panic in that case
-		out, err := kubectlDelete(file)
+		out, err := kubectlDelete(mf)
 		if err != nil && !strings.Contains(out, "NotFound") {
 			return fnLine(), err
 		}
-		os.Remove(file)
-		file = generateApodDeploy(ct.Tenant, summary.Image, podname, summary.ApodRepl)
-		if file == "" {
-			return fnLine(), errors.New("yaml fail")
-		}
+		mf.discard()
+		mf = generateApodDeploy(ct.Tenant, summary.Image, podname, summaryApodRepl(summary, podname))
 		// clustermgr might have crashed while in here and come back up and now
 		// we might be trying to delete something thats already deleted, so dont
 		// panic in that case
-		out, err = kubectlDelete(file)
+		out, err = kubectlDelete(mf)
 		if err != nil && !strings.Contains(out, "NotFound") {
 			return fnLine(), err
 		}
-		os.Remove(file)
+		mf.discard()
 	}
 
 	// Update the latest values first BEFORE trying to apply kubectl.
@@ -758,80 +1606,213 @@ func createAgentDeployments(ct *ClusterConfig) (string, error) {
 	// we handle that gracefully
 	summary.Tenant = ct.Tenant
 	summary.ApodRepl = ct.ApodRepl
-	summary.ApodSets = ct.ApodSets
-	summary.Image = ct.Image
+	summary.ApodSets = apodSets
+	summary.ApodSetsDyn = apodSets
+	if summary.ApodSetDraining != "" && summary.ApodSetDraining != getApodSetName(ct.Tenant, apodSets) {
+		// The set being drained is gone, or is not the last set anymore
+		summary.ApodSetDraining = ""
+	}
+	summary.ApodMaxRepl = ct.ApodMaxRepl
+	summary.ApodSetRepl = nil
+	if ct.ApodMaxRepl > 0 {
+		summary.ApodSetRepl = desired
+	}
+	if !rolling {
+		summary.Image = image
+		summary.RolloutImage = ""
+		summary.RolloutSets = 0
+		if image == ct.Image {
+			summary.RolloutFailed = ""
+		}
+	}
 	if err := DBUpdateTenantSummary(ct.Tenant, summary); err != nil {
 		return fnLine(), err
 	}
 
-	for i := 1; i <= ct.ApodSets; i++ {
+	for i := 1; i <= apodSets; i++ {
 		podname := getApodSetName(ct.Tenant, i)
-		file := generateApodDeploy(ct.Tenant, ct.Image, podname, ct.ApodRepl)
-		if file == "" {
-			return fnLine(), errors.New("yaml fail")
+		replicas := desired[podname]
+		// All the objects of the apod set go in one batch apply
+		batch := newApplyBatch(ct.Tenant, podname)
+		// With the HPA on, the replicas are left out of the StatefulSet. Else the
+		// server side apply would keep taking the replica count back from the HPA
+		deployRepl := replicas
+		if ct.ApodMaxRepl > 0 {
+			deployRepl = -1
 		}
-		err := kubectlApply(file)
-		if err != nil {
-			return fnLine(), err
+		setImage := image
+		if rolling && i > summary.RolloutSets+1 {
+			setImage = summary.Image
 		}
-		err = createApodService(ct.Tenant, podname, ct.ApodRepl)
-		if err != nil {
-			return fnLine(), err
+		batch.add(generateApodDeploy(ct.Tenant, setImage, podname, deployRepl))
+		if ct.ApodMaxRepl > 0 {
+			addApodHpa(batch, ct, podname)
 		}
-		err = createNxtForApod(ct.Tenant, podname, ct.ApodRepl)
-		if err != nil {
-			return fnLine(), err
+		addApodService(batch, ct.Tenant, podname, replicas)
+		addNxtForApod(batch, ct.Tenant, podname, replicas)
+		// No new user connections into a set thats being drained
+		if podname != summary.ApodSetDraining {
+			batch.add(generateApodNxtConnect(ct.Tenant, podname))
 		}
-		err = createApodNxtConnect(ct.Tenant, podname)
+		batch.add(generateApodHeadless(ct.Tenant, podname))
+		err := batch.apply()
 		if err != nil {
 			return fnLine(), err
 		}
-		file = generateApodHeadless(ct.Tenant, podname)
-		if file == "" {
-			return fnLine(), errors.New("cannot create headless file")
-		}
-		err = kubectlApply(file)
-		if err != nil {
-			return fnLine(), err
+		rollout := ""
+		if rolling && i == summary.RolloutSets+1 {
+			rollout = image
 		}
+		watchReady(ct.Tenant, "", podname, replicas, ct.Version, rolloutTimeout(ct), rollout)
 	}
 
 	return "", nil
 }
 
-func generateDockerCred(ns string) (string, error) {
+// The image pull secrets are copied from the default namespace into the tenant
+// namespaces as clean objects, with just the name, type and data of the source
+type kubeSecretMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+}
+
+type kubeSecret struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   kubeSecretMeta    `json:"metadata"`
+	Type       string            `json:"type,omitempty"`
+	Data       map[string]string `json:"data,omitempty"`
+}
+
+type kubeSecretList struct {
+	APIVersion string       `json:"apiVersion"`
+	Kind       string       `json:"kind"`
+	Items      []kubeSecret `json:"items"`
+}
+
+func getPullSecret(name string) (*kubeSecret, error) {
 	if unitTesting {
-		return "/tmp/" + ns + "/regcred.yaml", nil
+		return &kubeSecret{Metadata: kubeSecretMeta{Name: name}}, nil
 	}
-
-	// Copy the docker keys to the new namespace
-	file := "/tmp/" + ns + "/regcred.yaml"
-	cmd := exec.Command("kubectl", "get", "secret", "regcred", "--namespace=default", "-o", "yaml")
+	cmd := exec.Command("kubectl", "get", "secret", name, "--namespace=default", "-o", "json")
 	out, err := cmd.CombinedOutput()
 	if err != nil {
-		checkKubeHardErr(string(out))
-		glog.Error("Cannot read docker credentials", err.Error())
-		return "", err
+		kickKubeApi(string(out))
+		glog.Error("Cannot read pull secret ", name, ": ", string(out))
+		return nil, err
+	}
+	var secret kubeSecret
+	err = json.Unmarshal(out, &secret)
+	if err != nil {
+		glog.Error("Cannot parse pull secret ", name, ": ", err)
+		return nil, err
+	}
+	return &secret, nil
+}
+
+func getPullSecrets() ([]*kubeSecret, error) {
+	var secrets []*kubeSecret
+	for _, name := range PullSecrets {
+		secret, err := getPullSecret(name)
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, secret)
 	}
-	regcred := string(out)
-	reNspc := regexp.MustCompile(`namespace: default`)
-	nspcRepl := reNspc.ReplaceAllString(regcred, "namespace: "+common.TenantToNamespace(ns))
+	return secrets, nil
+}
 
-	// Replace some junk lines to make it legit yaml
-	re := regexp.MustCompile("(?m)[[:space:]]+(creationTimestamp:).*$")
-	nspcRepl = re.ReplaceAllString(nspcRepl, "")
-	re = regexp.MustCompile("(?m)[[:space:]]+(time:).*$")
-	nspcRepl = re.ReplaceAllString(nspcRepl, "")
-	re = regexp.MustCompile("(?m)[[:space:]]+(uid:).*$")
-	nspcRepl = re.ReplaceAllString(nspcRepl, "")
-	re = regexp.MustCompile("(?m)[[:space:]]+(resourceVersion:).*$")
-	nspcRepl = re.ReplaceAllString(nspcRepl, "")
+// Generate the copies of the pull secrets for the tenant, the sources can be nil if
+// the copies are generated just to be deleted
+func generatePullSecrets(ns string, sources []*kubeSecret) *manifest {
+	name := ns + "/pullsecrets.yaml"
+	list := kubeSecretList{APIVersion: "v1", Kind: "List"}
+	for i, secretName := range PullSecrets {
+		secret := kubeSecret{
+			APIVersion: "v1", Kind: "Secret",
+			Metadata: kubeSecretMeta{
+				Name: secretName, Namespace: common.TenantToNamespace(ns),
+				Labels: ownerLabels(ns, "", "", -1),
+			},
+		}
+		if i < len(sources) {
+			secret.Type = sources[i].Type
+			secret.Data = sources[i].Data
+		}
+		list.Items = append(list.Items, secret)
+	}
+	// json is valid yaml, kubectl doesnt care
+	yaml, err := json.MarshalIndent(&list, "", "  ")
+	if err != nil {
+		glog.Error("Cannot generate pull secrets for ", ns, ": ", err)
+		return nil
+	}
+	return renderManifest(name, string(yaml))
+}
 
-	if yamlFile(file, nspcRepl) == "" {
-		return "", errors.New("yaml file")
+func createPullSecrets(ns string) error {
+	sources, err := getPullSecrets()
+	if err != nil {
+		return err
+	}
+	mf := generatePullSecrets(ns, sources)
+	if mf == nil {
+		return errors.New("yaml fail")
 	}
+	return kubectlApply(mf)
+}
 
-	return file, nil
+// Keep an eye on the source pull secrets and push them to all the tenants when they
+// are rotated
+func pullSecretProcess() {
+	versions := make(map[string]string)
+	for {
+		time.Sleep(30 * time.Second)
+		if unitTesting {
+			continue
+		}
+		waitKubeApi()
+		sources, err := getPullSecrets()
+		if err != nil {
+			continue
+		}
+		rotated := false
+		for _, s := range sources {
+			if v, ok := versions[s.Metadata.Name]; ok && v != s.Metadata.ResourceVersion {
+				rotated = true
+			}
+		}
+		if rotated {
+			var names []string
+			eLock.Lock()
+			for tenant := range tenants {
+				names = append(names, tenant)
+			}
+			eLock.Unlock()
+			for _, tenant := range names {
+				mf := generatePullSecrets(tenant, sources)
+				if mf == nil {
+					err = errors.New("yaml fail")
+				} else {
+					err = kubectlApply(mf)
+				}
+				if err != nil {
+					// The versions are not updated, so we will try again in the next round
+					glog.Error("Pull secret update for ", tenant, " failed: ", err)
+					break
+				}
+			}
+			if err != nil {
+				continue
+			}
+			glog.Info("Pull secrets rotated, updated all tenants")
+		}
+		for _, s := range sources {
+			versions[s.Metadata.Name] = s.Metadata.ResourceVersion
+		}
+	}
 }
 
 func removeDir(directory string) {
@@ -848,222 +1829,1882 @@ func removeDir(directory string) {
 	os.Remove(directory)
 }
 
-func deleteNamespace(ns string, t *tenantInfo) (string, error) {
-	var outs string
+// Tenant delete goes through stages, each stage is recorded in the summary before
+// it starts so that we resume from the same stage if we crash in the middle of it
+const (
+	terminatingConnectors = "connectors"
+	terminatingApodSets   = "apodsets"
+	terminatingResources  = "resources"
+	terminatingNamespace  = "namespace"
+)
+
+func setTerminating(ns string, t *tenantInfo, stage string) error {
+	t.tenantSummary.Tenant = ns
+	t.tenantSummary.Terminating = stage
+	err := DBUpdateTenantSummary(ns, t.tenantSummary)
+	if err != nil {
+		return err
+	}
+	glog.Info("Tenant ", ns, " terminating: ", stage)
+	return nil
+}
+
+// Stage one of the tenant delete, remove all the connectors of the tenant
+func deleteTenantConnectors(ns string, t *tenantInfo) (string, error) {
+	// deleteConnector modifies the summary connectors, so go over a copy
+	connectors := append([]ConnectorSummary{}, t.tenantSummary.Connectors...)
+	draining := false
+	for _, c := range connectors {
+		errMsg, err := deleteConnector(ns, c.Id)
+		if errors.Is(err, errConnectorDraining) {
+			// Let all of them drain in parallel
+			draining = true
+			continue
+		}
+		if err != nil {
+			return errMsg, err
+		}
+	}
+	if draining {
+		return fnLine(), errConnectorDraining
+	}
+	t.bundleInfo = make(map[string]*bundleInfo)
+	return "", nil
+}
+
+// Stage two of the tenant delete, remove all the apod sets
+func deleteTenantApodSets(ns string, t *tenantInfo) (string, error) {
 	var err error
-	if len(t.tenantSummary.Connectors) != 0 || len(t.bundleInfo) != 0 {
-		glog.Infof("Delete Namespace: connectors:%d   bundleInfo:%d", len(t.tenantSummary.Connectors), len(t.bundleInfo))
-		return fnLine(), errors.New("Tenant still has bundles: " + ns)
+	sets := t.tenantSummary.ApodSets
+	if t.tenantSummary.ApodSetsDyn > sets {
+		sets = t.tenantSummary.ApodSetsDyn
 	}
-	for i := 1; i <= t.tenantSummary.ApodSets; i++ {
+	for i := 1; i <= sets; i++ {
 		podname := getApodSetName(ns, i)
-		err = deleteApodService(ns, podname, 0, t.tenantSummary.ApodRepl, true)
+		if t.tenantSummary.ApodMaxRepl > 0 {
+			err = deleteApodHpa(ns, podname)
+			if err != nil {
+				return fnLine(), err
+			}
+		}
+		err = deleteApodService(ns, podname, 0, summaryApodRepl(t.tenantSummary, podname), true)
 		if err != nil {
 			return fnLine(), err
 		}
-		file := generateApodHeadless(ns, podname)
-		if file == "" {
-			return fnLine(), errors.New("cannot create headless file")
+		err = deleteNxtForApod(ns, podname, 0, summaryApodRepl(t.tenantSummary, podname))
+		if err != nil {
+			return fnLine(), err
+		}
+		err = deleteApodNxtConnect(ns, podname)
+		if err != nil {
+			return fnLine(), err
 		}
+		mf := generateApodHeadless(ns, podname)
 		// clustermgr might have crashed while in here and come back up and now
 		// we might be trying to delete something thats already deleted, so dont
 		// panic in that case
-		outs, err := kubectlDelete(file)
+		outs, err := kubectlDelete(mf)
 		if err != nil && !strings.Contains(outs, "NotFound") {
 			return fnLine(), err
 		}
-		file = generateApodDeploy(ns, t.tenantSummary.Image, podname, t.tenantSummary.ApodRepl)
-		if file == "" {
-			return fnLine(), errors.New("yaml fail")
-		}
+		mf = generateApodDeploy(ns, t.tenantSummary.Image, podname, summaryApodRepl(t.tenantSummary, podname))
 		// clustermgr might have crashed while in here and come back up and now
 		// we might be trying to delete something thats already deleted, so dont
 		// panic in that case
-		outs, err = kubectlDelete(file)
+		outs, err = kubectlDelete(mf)
 		if err != nil && !strings.Contains(outs, "NotFound") {
 			return fnLine(), err
 		}
 	}
+	return "", nil
+}
 
-	file := generateTenantFlowControl(ns)
-	if file == "" {
-		return fnLine(), errors.New("yaml fail")
+// Stage three of the tenant delete, remove everything else mel created in the namespace
+func deleteTenantResources(ns string, t *tenantInfo) (string, error) {
+	var outs string
+	var err error
+	if t.tenantSummary.Quota != (TenantQuota{}) {
+		err = deleteTenantQuota(ns)
+		if err != nil {
+			return fnLine(), err
+		}
+	}
+	if len(t.tenantSummary.NetPolicyAllow) != 0 {
+		err = deleteNetPolicyExceptions(ns)
+		if err != nil {
+			return fnLine(), err
+		}
+	}
+	if t.tenantSummary.Tracing != "" {
+		err = deleteOtelCollector(ns)
+		if err != nil {
+			return fnLine(), err
+		}
 	}
+	mf := generateTenantNetPolicy(ns)
 	// clustermgr might have crashed while in here and come back up and now
 	// we might be trying to delete something thats already deleted, so dont
 	// panic in that case
-	outs, err = kubectlDelete(file)
+	outs, err = kubectlDelete(mf)
 	if err != nil && !strings.Contains(outs, "NotFound") {
 		return fnLine(), err
 	}
 
-	file, err = generateDockerCred(ns)
-	if err != nil {
+	mf = generateTenantAuthz(ns)
+	// clustermgr might have crashed while in here and come back up and now
+	// we might be trying to delete something thats already deleted, so dont
+	// panic in that case
+	outs, err = kubectlDelete(mf)
+	if err != nil && !strings.Contains(outs, "NotFound") {
 		return fnLine(), err
 	}
+
+	mf = generateTenantFlowControl(ns)
 	// clustermgr might have crashed while in here and come back up and now
 	// we might be trying to delete something thats already deleted, so dont
 	// panic in that case
-	outs, err = kubectlDelete(file)
+	outs, err = kubectlDelete(mf)
 	if err != nil && !strings.Contains(outs, "NotFound") {
 		return fnLine(), err
 	}
 
-	file = generateTenantRouteReflector(ns)
-	if file == "" {
+	mf = generatePullSecrets(ns, nil)
+	if mf == nil {
 		return fnLine(), errors.New("yaml fail")
 	}
 	// clustermgr might have crashed while in here and come back up and now
 	// we might be trying to delete something thats already deleted, so dont
 	// panic in that case
-	outs, err = kubectlDelete(file)
+	outs, err = kubectlDelete(mf)
 	if err != nil && !strings.Contains(outs, "NotFound") {
 		return fnLine(), err
 	}
 
-	cmd := exec.Command("kubectl", "delete", "namespace", common.TenantToNamespace(ns))
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		outs := string(out)
-		if !strings.Contains(outs, "NotFound") {
-			checkKubeHardErr(string(out))
-			glog.Error("Cannot delete namespace ", ns, ": ", outs)
-			return fnLine(), err
-		}
+	// Deleting just needs the names
+	mf = generateTenantRouteReflector(&ClusterConfig{Tenant: ns})
+	// clustermgr might have crashed while in here and come back up and now
+	// we might be trying to delete something thats already deleted, so dont
+	// panic in that case
+	outs, err = kubectlDelete(mf)
+	if err != nil && !strings.Contains(outs, "NotFound") {
+		return fnLine(), err
 	}
-	err = DBDeleteTenantSummary(ns)
-	if err != nil {
+
+	mf = generateTenantSecret(ns)
+	// clustermgr might have crashed while in here and come back up and now
+	// we might be trying to delete something thats already deleted, so dont
+	// panic in that case
+	outs, err = kubectlDelete(mf)
+	if err != nil && !strings.Contains(outs, "NotFound") {
 		return fnLine(), err
 	}
-	removeDir("/tmp/" + ns)
-	delete(tenants, ns)
+
 	return "", nil
 }
 
-func createNamespace(ns string) (string, error) {
-	cmd := exec.Command("kubectl", "create", "namespace", common.TenantToNamespace(ns))
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		outs := string(out)
-		if !strings.Contains(outs, "AlreadyExists") {
-			checkKubeHardErr(string(out))
-			glog.Error("Cannot create namespace ", ns, ": ", outs)
+func deleteNamespace(ns string, t *tenantInfo) (string, error) {
+	if t == nil {
+		// Nothing known about the tenant, so nothing to delete
+		return "", nil
+	}
+	if t.tenantSummary.Terminating == "" {
+		if err := setTerminating(ns, t, terminatingConnectors); err != nil {
+			return fnLine(), err
+		}
+	}
+	if t.tenantSummary.Terminating == terminatingConnectors {
+		errMsg, err := deleteTenantConnectors(ns, t)
+		if err != nil {
+			return errMsg, err
+		}
+		if err := setTerminating(ns, t, terminatingApodSets); err != nil {
+			return fnLine(), err
+		}
+	}
+	if t.tenantSummary.Terminating == terminatingApodSets {
+		errMsg, err := deleteTenantApodSets(ns, t)
+		if err != nil {
+			return errMsg, err
+		}
+		if err := setTerminating(ns, t, terminatingResources); err != nil {
+			return fnLine(), err
+		}
+	}
+	if t.tenantSummary.Terminating == terminatingResources {
+		errMsg, err := deleteTenantResources(ns, t)
+		if err != nil {
+			return errMsg, err
+		}
+		if err := setTerminating(ns, t, terminatingNamespace); err != nil {
+			return fnLine(), err
+		}
+	}
+
+	// Dont wait around for the namespace to go, it takes its time
+	cmd := exec.Command("kubectl", "delete", "namespace", common.TenantToNamespace(ns), "--wait=false")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		outs := string(out)
+		if !strings.Contains(outs, "NotFound") {
+			kickKubeApi(string(out))
+			glog.Error("Cannot delete namespace ", ns, ": ", outs)
+			return fnLine(), err
+		}
+	}
+	err = DBDeleteTenantSummary(ns)
+	if err != nil {
+		return fnLine(), err
+	}
+	err = DBDeleteTenantStatus(ns)
+	if err != nil {
+		glog.Error("Cannot delete status of ", ns, ": ", err)
+	}
+	if DebugDir != "" {
+		removeDir(filepath.Join(DebugDir, ns))
+	}
+	delete(tenants, ns)
+	return "", nil
+}
+
+func createNamespace(ns string) (string, error) {
+	cmd := exec.Command("kubectl", "create", "namespace", common.TenantToNamespace(ns))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		outs := string(out)
+		if !strings.Contains(outs, "AlreadyExists") {
+			kickKubeApi(string(out))
+			glog.Error("Cannot create namespace ", ns, ": ", outs)
 			return fnLine(), err
 		}
 	}
 	cmd = exec.Command("kubectl", "label", "namespace", common.TenantToNamespace(ns), "istio-injection=enabled", "--overwrite")
 	out, err = cmd.CombinedOutput()
 	if err != nil {
-		checkKubeHardErr(string(out))
+		kickKubeApi(string(out))
 		glog.Error("Cannot enable istio injection for namespace ", ns, ": ", string(out))
 		return fnLine(), err
 	}
 
-	file := generateTenantFlowControl(ns)
-	if file == "" {
-		return fnLine(), errors.New("yaml fail")
+	mf := generateTenantFlowControl(ns)
+	err = kubectlApply(mf)
+	if err != nil {
+		return fnLine(), err
+	}
+
+	mf = generateTenantNetPolicy(ns)
+	err = kubectlApply(mf)
+	if err != nil {
+		return fnLine(), err
+	}
+
+	mf = generateTenantAuthz(ns)
+	err = kubectlApply(mf)
+	if err != nil {
+		return fnLine(), err
+	}
+
+	err = createPullSecrets(ns)
+	if err != nil {
+		return fnLine(), err
+	}
+
+	err = createTenantSecret(ns)
+	if err != nil {
+		return fnLine(), err
+	}
+
+	// The route reflector is taken care of by updateNamespace, which
+	// has the tenant config
+	return "", nil
+}
+
+// Generate the ResourceQuota and LimitRange for the tenant
+func generateTenantQuota(t string, quota *TenantQuota) *manifest {
+	name := t + "/quota.yaml"
+	yaml := GetTenantQuota(t, quota)
+	yaml = AddOwnerLabels(yaml, ownerLabels(t, "", "", -1))
+	return renderManifest(name, yaml)
+}
+
+func deleteTenantQuota(tenant string) error {
+	mf := generateTenantQuota(tenant, &TenantQuota{})
+	out, err := kubectlDelete(mf)
+	if err != nil && !strings.Contains(out, "NotFound") {
+		return err
+	}
+	mf.discard()
+	return nil
+}
+
+func updateTenantQuota(ct *ClusterConfig) (string, error) {
+	summary := tenants[ct.Tenant].tenantSummary
+	if ct.Quota == (TenantQuota{}) {
+		if summary.Quota == (TenantQuota{}) {
+			return "", nil
+		}
+		// Quota removed, delete first and then update the summary
+		err := deleteTenantQuota(ct.Tenant)
+		if err != nil {
+			return fnLine(), err
+		}
+		summary.Quota = ct.Quota
+		err = DBUpdateTenantSummary(ct.Tenant, summary)
+		if err != nil {
+			return fnLine(), err
+		}
+		return "", nil
+	}
+	summary.Quota = ct.Quota
+	err := DBUpdateTenantSummary(ct.Tenant, summary)
+	if err != nil {
+		return fnLine(), err
+	}
+	mf := generateTenantQuota(ct.Tenant, &ct.Quota)
+	err = kubectlApply(mf)
+	if err != nil {
+		return fnLine(), err
+	}
+	return "", nil
+}
+
+// Generate the opentelemetry collector that the jaeger agents of the tenant's pods report to
+func generateOtelCollector(t string, exporter string) *manifest {
+	name := t + "/otel_collector.yaml"
+	yaml := GetOtelCollector(t, exporter)
+	yaml = AddOwnerLabels(yaml, ownerLabels(t, "", "", -1))
+	return renderManifest(name, yaml)
+}
+
+func deleteOtelCollector(tenant string) error {
+	mf := generateOtelCollector(tenant, "")
+	out, err := kubectlDelete(mf)
+	if err != nil && !strings.Contains(out, "NotFound") {
+		return err
+	}
+	mf.discard()
+	return nil
+}
+
+// The tenant's config decides the exporter, if it has none then the one mel is
+// configured with is used
+func tracingExporter(ct *ClusterConfig) string {
+	if !ct.Tracing {
+		return ""
+	}
+	if ct.TracingExporter != "" {
+		return ct.TracingExporter
+	}
+	return OtelExporter
+}
+
+func updateTracing(ct *ClusterConfig) (string, error) {
+	summary := tenants[ct.Tenant].tenantSummary
+	exporter := tracingExporter(ct)
+	if exporter == summary.Tracing {
+		return "", nil
+	}
+	if exporter == "" {
+		// Tracing turned off, delete first and then update the summary
+		err := deleteOtelCollector(ct.Tenant)
+		if err != nil {
+			return fnLine(), err
+		}
+		old := summary.Tracing
+		summary.Tracing = ""
+		err = DBUpdateTenantSummary(ct.Tenant, summary)
+		if err != nil {
+			summary.Tracing = old
+			return fnLine(), err
+		}
+		return "", nil
+	}
+	mf := generateOtelCollector(ct.Tenant, exporter)
+	err := kubectlApply(mf)
+	if err != nil {
+		return fnLine(), err
+	}
+	// Recorded only once applied, so a failed apply is tried again
+	old := summary.Tracing
+	summary.Tracing = exporter
+	err = DBUpdateTenantSummary(ct.Tenant, summary)
+	if err != nil {
+		summary.Tracing = old
+		return fnLine(), err
+	}
+	return "", nil
+}
+
+// Generate the NetworkPolicy for the namespace names in allow
+func generateNetPolicyExceptions(t string, allow []string) *manifest {
+	name := t + "/netpolicy_exceptions.yaml"
+	yaml := GetNetworkPolicyExceptions(t, allow)
+	yaml = AddOwnerLabels(yaml, ownerLabels(t, "", "", -1))
+	return renderManifest(name, yaml)
+}
+
+func deleteNetPolicyExceptions(tenant string) error {
+	mf := generateNetPolicyExceptions(tenant, nil)
+	out, err := kubectlDelete(mf)
+	if err != nil && !strings.Contains(out, "NotFound") {
+		return err
+	}
+	mf.discard()
+	return nil
+}
+
+func updateNetPolicyExceptions(ct *ClusterConfig) (string, error) {
+	summary := tenants[ct.Tenant].tenantSummary
+	if len(ct.NetPolicyAllow) == 0 {
+		if len(summary.NetPolicyAllow) == 0 {
+			return "", nil
+		}
+		// Exceptions removed, delete first and then update the summary
+		err := deleteNetPolicyExceptions(ct.Tenant)
+		if err != nil {
+			return fnLine(), err
+		}
+		summary.NetPolicyAllow = nil
+		err = DBUpdateTenantSummary(ct.Tenant, summary)
+		if err != nil {
+			return fnLine(), err
+		}
+		return "", nil
+	}
+	summary.NetPolicyAllow = ct.NetPolicyAllow
+	err := DBUpdateTenantSummary(ct.Tenant, summary)
+	if err != nil {
+		return fnLine(), err
+	}
+	mf := generateNetPolicyExceptions(ct.Tenant, ct.NetPolicyAllow)
+	err = kubectlApply(mf)
+	if err != nil {
+		return fnLine(), err
+	}
+	return "", nil
+}
+
+// The per-tenant settings of the namespace that can change along with the tenant config
+// The labels mel owns override anything configured with the same name
+func namespaceLabels(ct *ClusterConfig) map[string]string {
+	labels := make(map[string]string)
+	for k, v := range ct.NamespaceLabels {
+		labels[k] = v
+	}
+	labels["istio-injection"] = "enabled"
+	labels[labelManagedBy] = "mel"
+	labels[labelTenant] = ct.Tenant
+	labels["nextensio.io/cluster"] = MyCluster
+	if ct.CostCentre != "" {
+		labels["nextensio.io/cost-centre"] = ct.CostCentre
+	}
+	// istio-init needs NET_ADMIN, so anything stricter than privileged will
+	// have to come with the istio CNI
+	enforce := ct.PodSecurity
+	if enforce == "" {
+		enforce = "privileged"
+	}
+	warn := ct.PodSecurityWarn
+	if warn == "" {
+		warn = "baseline"
+	}
+	labels["pod-security.kubernetes.io/enforce"] = enforce
+	labels["pod-security.kubernetes.io/warn"] = warn
+	labels["pod-security.kubernetes.io/audit"] = warn
+	return labels
+}
+
+// Generate the namespace with all its labels and annotations
+func generateNamespace(ct *ClusterConfig) *manifest {
+	name := ct.Tenant + "/namespace.yaml"
+	yaml := GetNamespace(ct.Tenant, namespaceLabels(ct), ct.NamespaceAnnotations)
+	return renderManifest(name, yaml)
+}
+
+func labelNamespace(ct *ClusterConfig) (string, error) {
+	mf := generateNamespace(ct)
+	err := kubectlApply(mf)
+	if err != nil {
+		return fnLine(), err
+	}
+	return "", nil
+}
+
+func updateNamespace(ct *ClusterConfig) (string, error) {
+	errMsg, err := labelNamespace(ct)
+	if err != nil {
+		return errMsg, err
+	}
+	errMsg, err = updateTenantQuota(ct)
+	if err != nil {
+		return errMsg, err
+	}
+	errMsg, err = updateNetPolicyExceptions(ct)
+	if err != nil {
+		return errMsg, err
+	}
+	errMsg, err = updateRouteReflector(ct)
+	if err != nil {
+		return errMsg, err
+	}
+	errMsg, err = updateTracing(ct)
+	if err != nil {
+		return errMsg, err
+	}
+	return "", nil
+}
+
+func createTenants(clcfg *ClusterConfig) (string, error) {
+	t := tenants[clcfg.Tenant]
+	if t == nil || !t.created {
+		if t == nil {
+			tenants[clcfg.Tenant] = makeTenantInfo(clcfg.Tenant)
+			t = tenants[clcfg.Tenant]
+		}
+		// Unknown tenant, so create the namespace.
+		errMsg, err := createNamespace(clcfg.Tenant)
+		if err != nil {
+			return errMsg, err
+		}
+		t.created = true
+	}
+	t.markSweep = true
+	if t.tenantSummary.Terminating != "" {
+		// Let the delete finish first, the retry will create the tenant afresh
+		return fnLine(), errors.New("Tenant is terminating: " + clcfg.Tenant)
+	}
+
+	// The namespace labels etc.. are kept in sync on every reconcile, someone
+	// might have changed them behind our back
+	errMsg, err := updateNamespace(clcfg)
+	if err != nil {
+		return errMsg, err
+	}
+	if t.deployVersion != clcfg.Version {
+		errMsg, err = createAgentDeployments(clcfg)
+		if err != nil {
+			return errMsg, err
+		}
+		t.deployVersion = clcfg.Version
+	}
+	return "", nil
+}
+
+//-------------------------------------Autoscaling----------------------------------
+
+// Every apod replica has its own inside service and x-nextensio-for route, so as the
+// HPA scales the set up or down, those have to be added or removed. The replicas
+// are what the HPA has the StatefulSet at now
+func scaleApodSet(tenant string, summary *TenantSummary, podname string, replicas int) (string, error) {
+	var err error
+	current := summaryApodRepl(summary, podname)
+	if replicas == current {
+		return "", nil
+	}
+	if summary.ApodSetRepl == nil {
+		summary.ApodSetRepl = make(map[string]int)
+	}
+	if replicas < current {
+		// First delete from kubectl and THEN update the summary, like all other deletes
+		err = deleteApodService(tenant, podname, replicas, current, false)
+		if err != nil {
+			return fnLine(), err
+		}
+		err = deleteNxtForApod(tenant, podname, replicas, current)
+		if err != nil {
+			return fnLine(), err
+		}
+		summary.ApodSetRepl[podname] = replicas
+		err = DBUpdateTenantSummary(tenant, summary)
+		if err != nil {
+			summary.ApodSetRepl[podname] = current
+			return fnLine(), err
+		}
+	} else {
+		// Update the summary first and THEN apply, like all other creates
+		summary.ApodSetRepl[podname] = replicas
+		err = DBUpdateTenantSummary(tenant, summary)
+		if err != nil {
+			summary.ApodSetRepl[podname] = current
+			return fnLine(), err
+		}
+		batch := newApplyBatch(tenant, podname)
+		addApodService(batch, tenant, podname, replicas)
+		addNxtForApod(batch, tenant, podname, replicas)
+		err = batch.apply()
+		if err != nil {
+			// Put the summary back so that the next round tries the scale up again
+			summary.ApodSetRepl[podname] = current
+			if e := DBUpdateTenantSummary(tenant, summary); e != nil {
+				glog.Error("Cannot restore replicas of ", podname, ": ", e)
+			}
+			return fnLine(), err
+		}
+	}
+	glog.Info("Autoscaled ", podname, " from ", current, " to ", replicas)
+	return "", nil
+}
+
+// Add one more apod set when all the sets are loaded beyond the configured number of users.
+// And the last set (sets are numbered, so only the last one can go) is removed once its
+// empty: first the x-nextensio-connect route is removed so no new users land there, and
+// if the set is still empty in the next round, the set is deleted
+func scaleApodSets(tenant string, t *tenantInfo) (string, error) {
+	err, ct := DBFindTenantInCluster(tenant)
+	if err != nil {
+		return fnLine(), err
 	}
-	err = kubectlApply(file)
+	summary := t.tenantSummary
+	if ct == nil || !dynamicApodSets(ct) || summary.ApodSets == 0 {
+		return "", nil
+	}
+	// Better not to scale at all than to scale on user counts that dont add up
+	err = DBCheckUsersSchema()
 	if err != nil {
 		return fnLine(), err
 	}
+	sets := summary.ApodSets
+	loaded := 0
+	var users int64
+	for i := 1; i <= sets; i++ {
+		err, users = DBCountApodSetUsers(getApodSetName(tenant, i))
+		if err != nil {
+			return fnLine(), err
+		}
+		if users > int64(ct.ApodSetUsers) {
+			loaded++
+		}
+	}
+	// users is now the count for the last set
+	last := getApodSetName(tenant, sets)
+	want := sets
+	if loaded == sets && sets < ct.ApodSetsMax {
+		want = sets + 1
+	} else if users == 0 && sets > ct.ApodSets && loaded < sets-1 {
+		if summary.ApodSetDraining != last {
+			summary.ApodSetDraining = last
+			if err := DBUpdateTenantSummary(tenant, summary); err != nil {
+				summary.ApodSetDraining = ""
+				return fnLine(), err
+			}
+			if err := deleteApodNxtConnect(tenant, last); err != nil {
+				return fnLine(), err
+			}
+			glog.Info("Draining apod set ", last)
+			return "", nil
+		}
+		want = sets - 1
+	} else if summary.ApodSetDraining == last {
+		// Users showed up while draining or the other sets got loaded, put the set back in service
+		if err := createApodNxtConnect(tenant, last); err != nil {
+			return fnLine(), err
+		}
+		summary.ApodSetDraining = ""
+		if err := DBUpdateTenantSummary(tenant, summary); err != nil {
+			return fnLine(), err
+		}
+		glog.Info("Stopped draining apod set ", last)
+		return "", nil
+	}
+	if want == sets {
+		return "", nil
+	}
+	glog.Info("Apod sets for ", tenant, " going from ", sets, " to ", want)
+	summary.ApodSetsDyn = want
+	errMsg, err := createAgentDeployments(ct)
+	if err != nil {
+		return errMsg, err
+	}
+	t.deployVersion = ct.Version
+	return "", nil
+}
+
+// Keep an eye on the replica counts of autoscaled apod sets and the user load on the
+// apod sets
+func apodScaleProcess() {
+	for {
+		time.Sleep(10 * time.Second)
+		if unitTesting {
+			continue
+		}
+		waitKubeApi()
+		// The replicas come from the listing, taken without the eLock
+		listedAt := time.Now()
+		sets, err := listStatefulSets()
+		if err != nil {
+			glog.Error("Autoscale cannot list statefulsets: ", err)
+			continue
+		}
+		eLock.Lock()
+		for tenant, t := range tenants {
+			if t.tenantSummary.Terminating != "" {
+				continue
+			}
+			if t.deployedAt.After(listedAt) {
+				// The listing is older than what got applied, wait for the next one
+				continue
+			}
+			errMsg, err := scaleApodSets(tenant, t)
+			if err != nil {
+				glog.Error("Scaling apod sets of ", tenant, " failed: ", err, " ", errMsg)
+			}
+			if t.tenantSummary.ApodMaxRepl <= 0 {
+				continue
+			}
+			for i := 1; i <= t.tenantSummary.ApodSets; i++ {
+				podname := getApodSetName(tenant, i)
+				ss := sets[common.TenantToNamespace(tenant)+"/"+podname]
+				if ss == nil {
+					continue
+				}
+				errMsg, err := scaleApodSet(tenant, t.tenantSummary, podname, ss.Spec.Replicas)
+				if err != nil {
+					// Will try again in the next round
+					glog.Error("Autoscale of ", podname, " failed: ", err, " ", errMsg)
+				}
+			}
+		}
+		eLock.Unlock()
+	}
+}
+
+//-------------------------------------Events--------------------------------------
+
+// Generate a kubernetes Event, the event names have to be unique so they
+// are suffixed with the time
+func generateEvent(tenant string, kind string, object string, eventType string, reason string, message string) *manifest {
+	now := time.Now()
+	name := object + "." + strconv.FormatInt(now.UnixNano(), 16)
+	yaml := GetEvent(tenant, kind, object, name, eventType, reason, message, now.UTC().Format(time.RFC3339))
+	return renderManifest(tenant+"/event.yaml", yaml)
+}
+
+// The events are on the connector's StatefulSet if there is a connector and
+// its StatefulSet is around, otherwise on the tenant's namespace
+func eventObject(tenant string, connector string) (string, string) {
+	if connector != "" {
+		c := summaryConnector(tenant, connector)
+		if c != nil {
+			return "StatefulSet", c.Connectid
+		}
+	}
+	return "Namespace", common.TenantToNamespace(tenant)
+}
+
+// Publish an event on how a tenant/connector create, update or delete went. The
+// events are just informational, so failing to publish one is not an error
+func recordEvent(tenant string, connector string, collection string, op string, err error, errMsg string) {
+	if unitTesting || tenant == "" {
+		return
+	}
+	what := "Tenant"
+	if collection == "NxtConnectors" {
+		what = "Connector"
+	}
+	var action string
+	switch op {
+	case "insert":
+		action = "Create"
+	case "update":
+		action = "Update"
+	case "delete":
+		action = "Delete"
+		if err == nil && collection == "NxtTenants" {
+			// Namespace is gone, nowhere to put the event
+			return
+		}
+	default:
+		return
+	}
+	eventType := "Normal"
+	reason := what + action + "d"
+	message := what + " " + action + " done"
+	if connector != "" {
+		message = message + ": " + connector
+	}
+	if errors.Is(err, errConnectorDraining) {
+		reason = "ConnectorDraining"
+		message = "Connector draining before delete: " + connector
+	} else if err != nil {
+		eventType = "Warning"
+		reason = what + action + "Failed"
+		message = errMsg + ": " + err.Error()
+	}
+	kind, object := eventObject(tenant, connector)
+	mf := generateEvent(tenant, kind, object, eventType, reason, message)
+	// Its called with eLock held, so leave the kubectl to eventProcess
+	select {
+	case eventQueue <- mf:
+	default:
+		glog.Error("Event queue full, dropping event ", reason, " for ", tenant)
+		mf.discard()
+	}
+}
+
+// The events waiting to be created by eventProcess
+var eventQueue = make(chan *manifest, 1000)
+
+func eventProcess() {
+	for mf := range eventQueue {
+		waitKubeApi()
+		cmd := exec.Command("kubectl", "create", "-f", "-")
+		cmd.Stdin = strings.NewReader(mf.yaml)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			kickKubeApi(string(out))
+			glog.Error("Cannot create event ", mf.name, ": ", string(out))
+		}
+		mf.discard()
+	}
+}
+
+//-------------------------------------Status--------------------------------------
+
+const (
+	phasePending  = "Pending"
+	phaseApplying = "Applying"
+	phaseReady    = "Ready"
+	phaseDegraded = "Degraded"
+	phaseDeleting = "Deleting"
+)
+
+// The connector's entry in the tenant summary, nil if the connector is not deployed
+func summaryConnector(tenant string, connector string) *ConnectorSummary {
+	t := tenants[tenant]
+	if t == nil {
+		return nil
+	}
+	for i := range t.tenantSummary.Connectors {
+		if t.tenantSummary.Connectors[i].Id == connector {
+			return &t.tenantSummary.Connectors[i]
+		}
+	}
+	return nil
+}
+
+func statusId(tenant string, connector string) string {
+	if connector != "" {
+		return connector
+	}
+	return tenant
+}
+
+// The version of the tenant's or connector's config, zero if the config is gone
+func configVersion(tenant string, connector string) int {
+	if connector == "" {
+		err, clcfg := DBFindTenantInCluster(tenant)
+		if err != nil || clcfg == nil {
+			return 0
+		}
+		return clcfg.Version
+	}
+	err, bundle := DBFindClusterBundle(tenant, strings.TrimPrefix(connector, tenant+":"))
+	if err != nil || bundle == nil {
+		return 0
+	}
+	return bundle.Version
+}
+
+// The number of ready pods of a StatefulSet as of the last listing, zero if it cant be found
+func statefulSetReadyReplicas(namespace string, name string) int {
+	ss := statefulSets[namespace+"/"+name]
+	if ss == nil {
+		return 0
+	}
+	return ss.Status.ReadyReplicas
+}
+
+// The replicas and the ready replicas of the tenant's apod sets or the connector's cpod
+func statusReplicas(tenant string, connector string) (int, int) {
+	namespace := common.TenantToNamespace(tenant)
+	if connector != "" {
+		c := summaryConnector(tenant, connector)
+		if c == nil {
+			return 0, 0
+		}
+		return c.CpodRepl, statefulSetReadyReplicas(namespace, c.Connectid)
+	}
+	t := tenants[tenant]
+	if t == nil {
+		return 0, 0
+	}
+	replicas := 0
+	ready := 0
+	for i := 1; i <= t.tenantSummary.ApodSets; i++ {
+		podname := getApodSetName(tenant, i)
+		replicas += summaryApodRepl(t.tenantSummary, podname)
+		ready += statefulSetReadyReplicas(namespace, podname)
+	}
+	return replicas, ready
+}
+
+// Move the status to the given phase. Once applied (phase Ready), the status is
+// Ready or Pending based on how many replicas are ready. The transition time moves
+// only if the phase changes, and nothing is written if nothing changed
+func putStatus(tenant string, connector string, old *Status, phase string, lastError string) {
+	status := Status{Id: statusId(tenant, connector), Tenant: tenant}
+	if old != nil {
+		status = *old
+	}
+	if c := summaryConnector(tenant, connector); c != nil {
+		status.Connectid = c.Connectid
+	}
+	if version := configVersion(tenant, connector); version != 0 {
+		status.ObservedVersion = version
+	}
+	status.Phase = phase
+	status.LastError = lastError
+	if phase == phaseReady {
+		status.AppliedVersion = status.ObservedVersion
+		status.Replicas, status.ReadyReplicas = statusReplicas(tenant, connector)
+		if status.ReadyReplicas < status.Replicas {
+			status.Phase = phasePending
+		}
+		t := tenants[tenant]
+		if connector == "" && t != nil && t.tenantSummary.RolloutFailed != "" {
+			status.Phase = phaseDegraded
+			status.LastError = "Rollout failed for image " + t.tenantSummary.RolloutFailed
+		}
+	}
+	if old == nil || old.Phase != status.Phase {
+		status.TransitionAt = time.Now().Format(time.RFC1123)
+	}
+	if old != nil && *old == status {
+		return
+	}
+	err := DBUpdateStatus(&status)
+	if err != nil {
+		glog.Error("Status update failed for ", status.Id, ": ", err)
+	}
+}
+
+func setStatus(tenant string, connector string, phase string, lastError string) {
+	err, old := DBFindStatus(statusId(tenant, connector))
+	if err != nil {
+		glog.Error("Status find failed for ", statusId(tenant, connector), ": ", err)
+		return
+	}
+	putStatus(tenant, connector, old, phase, lastError)
+}
+
+// A config change is being worked on
+func observeStatus(tenant string, connector string, op string) {
+	if tenant == "" {
+		return
+	}
+	if op == "delete" {
+		setStatus(tenant, connector, phaseDeleting, "")
+	} else {
+		setStatus(tenant, connector, phaseApplying, "")
+	}
+}
+
+// Update the status with how a tenant/connector create, update or delete went, the
+// status goes away along with the connector. The tenant's status (and that of all
+// its connectors) is deleted along with the namespace
+func opStatus(tenant string, connector string, op string, err error, errMsg string) {
+	if tenant == "" {
+		return
+	}
+	switch {
+	case op == "delete" && err == nil:
+		if connector != "" {
+			e := DBDeleteStatus(connector)
+			if e != nil {
+				glog.Error("Status delete failed for ", connector, ": ", e)
+			}
+		}
+	case errors.Is(err, errConnectorDraining):
+		setStatus(tenant, connector, phaseDeleting, "")
+	case err != nil:
+		phase := phaseDegraded
+		if op == "delete" {
+			phase = phaseDeleting
+		}
+		setStatus(tenant, connector, phase, errMsg+":"+err.Error())
+	default:
+		setStatus(tenant, connector, phaseReady, "")
+	}
+}
+
+// Pick up replicas coming up (or going down) after the config was applied
+func refreshStatus(tenant string, connector string) {
+	err, old := DBFindStatus(statusId(tenant, connector))
+	if err != nil || old == nil {
+		return
+	}
+	if old.Phase != phaseReady && old.Phase != phasePending {
+		return
+	}
+	putStatus(tenant, connector, old, phaseReady, "")
+}
+
+func statusProcess() {
+	for {
+		time.Sleep(30 * time.Second)
+		if unitTesting {
+			continue
+		}
+		waitKubeApi()
+		// The ready replicas come from the listing, taken without the eLock
+		sets, err := listStatefulSets()
+		if err != nil {
+			glog.Error("Status cannot list statefulsets: ", err)
+			continue
+		}
+		eLock.Lock()
+		statefulSets = sets
+		for tenant, t := range tenants {
+			if t.tenantSummary.Terminating != "" {
+				continue
+			}
+			refreshStatus(tenant, "")
+			for _, c := range t.tenantSummary.Connectors {
+				refreshStatus(tenant, c.Id)
+			}
+		}
+		eLock.Unlock()
+	}
+}
+
+//-------------------------------------Readiness-----------------------------------
+
+// A StatefulSet thats been applied and is yet to have all its pods ready. The
+// connector is empty for an apod set. Reported says the pods were not ready by
+// the deadline and a NotReady error was recorded for it. Rollout is the image an
+// apod set is being moved to in a rolling upgrade
+type readyWatch struct {
+	tenant    string
+	connector string
+	name      string
+	replicas  int
+	version   int
+	started   time.Time
+	deadline  time.Time
+	reported  bool
+	rollout   string
+}
+
+// Keyed by namespace/name, the watches are worked on with the eLock held
+var readyWatches = make(map[string]*readyWatch)
+
+// Start watching a StatefulSet after its applied, a newer apply of the same
+// StatefulSet takes over the watch
+func watchReady(tenant string, connector string, name string, replicas int, version int, timeout time.Duration, rollout string) {
+	key := common.TenantToNamespace(tenant) + "/" + name
+	w := &readyWatch{
+		tenant: tenant, connector: connector, name: name, replicas: replicas,
+		version: version, started: time.Now(), deadline: time.Now().Add(timeout), rollout: rollout,
+	}
+	if old := readyWatches[key]; old != nil {
+		w.reported = old.reported
+	}
+	readyWatches[key] = w
+}
+
+// The StatefulSet is still around if the tenant is, and the connector or the
+// apod set is still in the tenant summary
+func readyWatchValid(w *readyWatch) bool {
+	t := tenants[w.tenant]
+	if t == nil || t.tenantSummary.Terminating != "" {
+		return false
+	}
+	if w.connector != "" {
+		return summaryConnector(w.tenant, w.connector) != nil
+	}
+	for i := 1; i <= t.tenantSummary.ApodSets; i++ {
+		if getApodSetName(w.tenant, i) == w.name {
+			return true
+		}
+	}
+	return false
+}
+
+// The watched StatefulSet has all its pods ready as per the listing
+func watchedReady(w *readyWatch, sets map[string]*kubeStatefulSet) bool {
+	if unitTesting {
+		return GetEnv("TEST_KUBE_ERR", "NOT_TEST") != "true" && GetEnv("TEST_ROLLOUT_ERR", "NOT_TEST") != "true"
+	}
+	ss := sets[common.TenantToNamespace(w.tenant)+"/"+w.name]
+	return ss != nil && ss.ready(w.replicas)
+}
+
+// Why the pods of the StatefulSet are waiting, like ImagePullBackOff or CrashLoopBackOff
+func podWaitingReason(namespace string, name string) string {
+	if unitTesting {
+		return "PodsNotReady"
+	}
+	jpath := "jsonpath={.items[*].status.initContainerStatuses[*].state.waiting.reason} " +
+		"{.items[*].status.containerStatuses[*].state.waiting.reason}"
+	cmd := exec.Command("kubectl", "get", "pods", "-n", namespace, "-l", "app="+name, "-o", jpath)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		kickKubeApi(string(out))
+		return "Unknown"
+	}
+	var reasons []string
+	seen := make(map[string]bool)
+	for _, r := range strings.Fields(string(out)) {
+		if !seen[r] {
+			seen[r] = true
+			reasons = append(reasons, r)
+		}
+	}
+	if len(reasons) == 0 {
+		return "PodsNotReady"
+	}
+	return strings.Join(reasons, ",")
+}
+
+func readyErrRec(w *readyWatch) *ErrRec {
+	collection := "NxtTenants"
+	if w.connector != "" {
+		collection = "NxtConnectors"
+	}
+	return &ErrRec{Tenant: w.tenant, Connectid: w.name, Collection: collection, Type: errType(errNotReady)}
+}
+
+// Record the config version whose pods all came up ready, for a tenant thats
+// once none of its apod sets are waiting to be ready
+func readyStatus(w *readyWatch) {
+	for _, o := range readyWatches {
+		if o != w && o.tenant == w.tenant && o.connector == w.connector {
+			return
+		}
+	}
+	err, status := DBFindStatus(statusId(w.tenant, w.connector))
+	if err != nil || status == nil || status.ReadyVersion == w.version {
+		return
+	}
+	status.ReadyVersion = w.version
+	err = DBUpdateStatus(status)
+	if err != nil {
+		glog.Error("Status update failed for ", status.Id, ": ", err)
+	}
+}
+
+// The apod set being rolled out is ready, move the next set to the new image. Once
+// all the sets are on it, the new image goes into the summary
+func rolloutReady(w *readyWatch) error {
+	t := tenants[w.tenant]
+	summary := t.tenantSummary
+	if summary.RolloutImage != w.rollout {
+		// The config moved on to some other image since
+		return nil
+	}
+	err, ct := DBFindTenantInCluster(w.tenant)
+	if err != nil {
+		return err
+	}
+	if ct == nil {
+		return nil
+	}
+	glog.Info("Rollout of ", w.name, " to ", w.rollout, " done")
+	old := *summary
+	summary.RolloutSets++
+	if summary.RolloutSets >= summary.ApodSets {
+		summary.Image = w.rollout
+		summary.RolloutImage = ""
+		summary.RolloutSets = 0
+	}
+	err = DBUpdateTenantSummary(w.tenant, summary)
+	if err != nil {
+		*summary = old
+		return err
+	}
+	// Failing to move the next set is retried like any other tenant update
+	errMsg, err := createAgentDeployments(ct)
+	if err != nil {
+		addError(err, errMsg, "update", "NxtTenants", w.tenant, "")
+		return nil
+	}
+	t.deployVersion = ct.Version
+	return nil
+}
+
+// The apod set being rolled out did not become ready in time. The image is not tried
+// again, and with RolloutRevert all the sets are put back on the old image
+func rolloutFailed(w *readyWatch) error {
+	t := tenants[w.tenant]
+	summary := t.tenantSummary
+	if summary.RolloutImage != w.rollout {
+		return nil
+	}
+	err, ct := DBFindTenantInCluster(w.tenant)
+	if err != nil {
+		return err
+	}
+	if ct == nil {
+		return nil
+	}
+	glog.Error("Rollout of ", w.name, " to ", w.rollout, " failed")
+	old := *summary
+	summary.RolloutFailed = w.rollout
+	summary.RolloutImage = ""
+	summary.RolloutSets = 0
+	err = DBUpdateTenantSummary(w.tenant, summary)
+	if err != nil {
+		*summary = old
+		return err
+	}
+	if ct.RolloutRevert {
+		errMsg, err := createAgentDeployments(ct)
+		if err != nil {
+			addError(err, errMsg, "update", "NxtTenants", w.tenant, "")
+		} else {
+			t.deployVersion = ct.Version
+		}
+	}
+	// The failure shows up in the tenant status, not as an error to retry
+	setStatus(w.tenant, "", phaseReady, "")
+	return nil
+}
+
+// Check one watched StatefulSet against a listing taken after the watch started,
+// returns true once the watch is done with, and whether the StatefulSet is past
+// its deadline and is yet to be reported
+func checkReady(w *readyWatch, sets map[string]*kubeStatefulSet) (bool, bool) {
+	if !readyWatchValid(w) {
+		return true, false
+	}
+	if watchedReady(w, sets) {
+		if w.rollout != "" {
+			err := rolloutReady(w)
+			if err != nil {
+				// Try again the next round
+				glog.Error("Rollout of ", w.name, " cannot move on: ", err)
+				return false, false
+			}
+		}
+		if w.reported {
+			if err := DBDelErrRec(readyErrRec(w)); err != nil {
+				glog.Error("Cannot delete NotReady error of ", w.name, ": ", err)
+			}
+			setStatus(w.tenant, w.connector, phaseReady, "")
+		}
+		readyStatus(w)
+		glog.Info("StatefulSet ready ", w.tenant, " ", w.name, " version ", w.version)
+		return true, false
+	}
+	if !time.Now().After(w.deadline) {
+		return false, false
+	}
+	if w.rollout != "" {
+		err := rolloutFailed(w)
+		if err != nil {
+			glog.Error("Rollout of ", w.name, " cannot be failed: ", err)
+			return false, false
+		}
+		w.rollout = ""
+	}
+	return false, !w.reported
+}
+
+// A kubernetes Event as listed by kubectl, just the fields to match it to a StatefulSet
+type kubeEvent struct {
+	InvolvedObject struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"involvedObject"`
+	Message       string `json:"message"`
+	LastTimestamp string `json:"lastTimestamp"`
+	EventTime     string `json:"eventTime"`
+}
+
+type kubeEventList struct {
+	Items []kubeEvent `json:"items"`
+}
+
+// The last time a StatefulSet could not create its pods for want of quota
+type quotaFailure struct {
+	at      time.Time
+	message string
+}
+
+// The apply of a StatefulSet goes through fine even when the namespace is out of cpu,
+// memory or pod quota, its the StatefulSet that cant create the pods then. That shows
+// up only as FailedCreate events of the StatefulSet, these are keyed by namespace/name
+func listQuotaFailures() (map[string]*quotaFailure, error) {
+	failures := make(map[string]*quotaFailure)
+	if unitTesting {
+		return failures, nil
+	}
+	cmd := exec.Command("kubectl", "get", "events", "--all-namespaces",
+		"--field-selector", "involvedObject.kind=StatefulSet,reason=FailedCreate", "-o", "json")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		kickKubeApi(string(out))
+		return nil, errors.New(string(out))
+	}
+	var list kubeEventList
+	err = json.Unmarshal(out, &list)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range list.Items {
+		if !strings.Contains(e.Message, "exceeded quota") {
+			continue
+		}
+		stamp := e.LastTimestamp
+		if stamp == "" {
+			stamp = e.EventTime
+		}
+		at, err := time.Parse(time.RFC3339, stamp)
+		if err != nil {
+			continue
+		}
+		key := e.InvolvedObject.Namespace + "/" + e.InvolvedObject.Name
+		if f := failures[key]; f == nil || at.After(f.at) {
+			failures[key] = &quotaFailure{at: at, message: e.Message}
+		}
+	}
+	return failures, nil
+}
+
+// The StatefulSet ran out of quota since the watch started, the event times are in seconds
+func quotaFailed(w *readyWatch, f *quotaFailure) bool {
+	return f != nil && !f.at.Before(w.started.Truncate(time.Second))
+}
+
+// Record a NotReady error for a StatefulSet whose pods were not ready by the deadline,
+// or that ran out of quota
+func reportNotReady(w *readyWatch, err error, reason string) {
+	errRec := readyErrRec(w)
+	errRec.Error = fnLine() + ":" + err.Error()
+	errRec.Reason = reason
+	errRec.ChangeAt = time.Now().Format(time.RFC1123)
+	if e := DBAddErrRec(errRec); e != nil {
+		// Try again the next round
+		glog.Error("Cannot add NotReady error of ", w.name, ": ", e)
+		return
+	}
+	setStatus(w.tenant, w.connector, phaseDegraded, errRec.Error)
+	recordEvent(w.tenant, w.connector, errRec.Collection, "update", err, fnLine())
+	w.reported = true
+	glog.Error("StatefulSet not ready ", w.tenant, " ", w.name, ": ", reason)
+}
+
+// Keep watching the applied StatefulSets till their pods are ready. The ones that
+// are not ready past the deadline, or that ran out of quota, are reported once and
+// watched till they are ready. The StatefulSets and their events are listed and the
+// pods of the late ones looked at without the eLock, the watches are worked on with it
+func readinessProcess() {
+	for {
+		time.Sleep(10 * time.Second)
+		waitKubeApi()
+		listedAt := time.Now()
+		sets, err := listStatefulSets()
+		if err != nil {
+			glog.Error("Readiness cannot list statefulsets: ", err)
+			continue
+		}
+		quotas, err := listQuotaFailures()
+		if err != nil {
+			// The deadline still catches the ones out of quota
+			glog.Error("Readiness cannot list events: ", err)
+		}
+		var late []*readyWatch
+		eLock.Lock()
+		statefulSets = sets
+		for key, w := range readyWatches {
+			if w.started.After(listedAt) {
+				continue
+			}
+			done, isLate := checkReady(w, sets)
+			if done && readyWatches[key] == w {
+				delete(readyWatches, key)
+			}
+			if !done && !w.reported && quotaFailed(w, quotas[key]) {
+				isLate = true
+			}
+			if isLate {
+				late = append(late, w)
+			}
+		}
+		eLock.Unlock()
+
+		errs := make(map[*readyWatch]error)
+		reasons := make(map[*readyWatch]string)
+		for _, w := range late {
+			key := common.TenantToNamespace(w.tenant) + "/" + w.name
+			if f := quotas[key]; quotaFailed(w, f) {
+				reasons[w] = errType(errQuotaExceeded)
+				errs[w] = fmt.Errorf("%w: %s: %s", errQuotaExceeded, w.name, f.message)
+				continue
+			}
+			reasons[w] = podWaitingReason(common.TenantToNamespace(w.tenant), w.name)
+			errs[w] = fmt.Errorf("%w: %s: %s", errNotReady, w.name, reasons[w])
+		}
+		eLock.Lock()
+		for _, w := range late {
+			key := common.TenantToNamespace(w.tenant) + "/" + w.name
+			if readyWatches[key] == w && !w.reported {
+				reportNotReady(w, errs[w], reasons[w])
+			}
+		}
+		eLock.Unlock()
+	}
+}
+
+//-------------------------------Garbage collection---------------------------------
+
+// The kinds of objects mel creates in the tenant namespaces
+const gcKinds = "statefulsets,deployments,services,horizontalpodautoscalers,secrets," +
+	"networkpolicies,resourcequotas,limitranges," +
+	"envoyfilters.networking.istio.io,virtualservices.networking.istio.io," +
+	"destinationrules.networking.istio.io,peerauthentications.security.istio.io," +
+	"authorizationpolicies.security.istio.io"
+
+type kubeObjectMeta struct {
+	Name      string            `json:"name"`
+	Namespace string            `json:"namespace"`
+	Labels    map[string]string `json:"labels"`
+}
+
+type kubeObject struct {
+	APIVersion string         `json:"apiVersion"`
+	Kind       string         `json:"kind"`
+	Metadata   kubeObjectMeta `json:"metadata"`
+}
+
+type kubeObjectList struct {
+	Items []kubeObject `json:"items"`
+}
+
+func kubectlGetOwned(kinds string) ([]kubeObject, error) {
+	cmd := exec.Command("kubectl", "get", kinds, "--all-namespaces", "-l", labelManagedBy+"=mel,"+labelTenant, "-o", "json")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		kickKubeApi(string(out))
+		return nil, errors.New(string(out))
+	}
+	var list kubeObjectList
+	err = json.Unmarshal(out, &list)
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// An object is an orphan if the connector, apod set or replica its labelled with
+// is not in the tenant summary. Objects of unknown tenants are left alone, they
+// go away with the namespace
+func gcOrphan(o *kubeObject) bool {
+	t := tenants[o.Metadata.Labels[labelTenant]]
+	if t == nil || t.tenantSummary.Terminating != "" {
+		return false
+	}
+	summary := t.tenantSummary
+	replica := -1
+	if r, ok := o.Metadata.Labels[labelReplica]; ok {
+		n, err := strconv.Atoi(r)
+		if err != nil {
+			return false
+		}
+		replica = n
+	}
+	if connector, ok := o.Metadata.Labels[labelConnector]; ok {
+		for _, c := range summary.Connectors {
+			if c.Connectid == connector {
+				return replica >= c.CpodRepl
+			}
+		}
+		return true
+	}
+	if podname, ok := o.Metadata.Labels[labelApodSet]; ok {
+		sets := summary.ApodSets
+		if summary.ApodSetsDyn > sets {
+			sets = summary.ApodSetsDyn
+		}
+		for i := 1; i <= sets; i++ {
+			if getApodSetName(summary.Tenant, i) == podname {
+				return replica >= summaryApodRepl(summary, podname)
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// The resource name kubectl understands for the object, qualified with the
+// api group if there is one
+func gcResource(o *kubeObject) string {
+	kind := strings.ToLower(o.Kind)
+	if i := strings.Index(o.APIVersion, "/"); i != -1 {
+		kind = kind + "." + o.APIVersion[:i]
+	}
+	return kind
+}
+
+// Delete a namespace labelled as owned by mel if mel doesnt know of its tenant anymore
+func gcNamespace(n *kubeObject, dryRun bool) {
+	tenant := n.Metadata.Labels[labelTenant]
+	if tenants[tenant] != nil {
+		return
+	}
+	// A whole namespace is a lot to lose, so make sure the tenant's config is really gone
+	err, clcfgs := DBFindAllTenantsInCluster()
+	if err != nil {
+		glog.Error("GC cannot confirm namespace ", n.Metadata.Name, " is orphan: ", err)
+		return
+	}
+	for _, c := range clcfgs {
+		if c.Tenant == tenant {
+			return
+		}
+	}
+	glog.Info("GC orphan namespace ", n.Metadata.Name, " dryrun ", dryRun)
+	if dryRun {
+		return
+	}
+	// Dont wait around for the namespace to go, it takes its time
+	cmd := exec.Command("kubectl", "delete", "namespace", n.Metadata.Name, "--wait=false")
+	out, err := cmd.CombinedOutput()
+	if err != nil && !strings.Contains(string(out), "NotFound") {
+		glog.Error("GC cannot delete namespace ", n.Metadata.Name, ": ", string(out))
+	}
+}
+
+func gcObject(o *kubeObject, dryRun bool) {
+	if !gcOrphan(o) {
+		return
+	}
+	resource := gcResource(o)
+	glog.Info("GC orphan ", resource, " ", o.Metadata.Namespace, "/", o.Metadata.Name, " dryrun ", dryRun)
+	if dryRun {
+		return
+	}
+	cmd := exec.Command("kubectl", "delete", resource, o.Metadata.Name, "-n", o.Metadata.Namespace)
+	out, err := cmd.CombinedOutput()
+	if err != nil && !strings.Contains(string(out), "NotFound") {
+		glog.Error("GC cannot delete ", resource, " ", o.Metadata.Name, ": ", string(out))
+	}
+}
+
+// Find the objects labelled as owned by mel which dont map to anything in the
+// tenant summaries and delete them (or just log them if dryRun). Namespaces of
+// tenants mel doesnt know of anymore are deleted as a whole. The listing is done
+// without the eLock, each object is checked and deleted with the eLock held so
+// that it cant race with a reconcile of its tenant
+func gcOrphans(dryRun bool) {
+	cmd := exec.Command("kubectl", "get", "namespaces", "-l", labelManagedBy+"=mel,"+labelTenant, "-o", "json")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		kickKubeApi(string(out))
+		glog.Error("GC cannot list namespaces: ", string(out))
+		return
+	}
+	var namespaces kubeObjectList
+	err = json.Unmarshal(out, &namespaces)
+	if err != nil {
+		glog.Error("GC cannot parse namespaces: ", err)
+		return
+	}
+	objects, err := kubectlGetOwned(gcKinds)
+	if err != nil {
+		glog.Error("GC cannot list objects: ", err)
+		return
+	}
+	for i := range namespaces.Items {
+		eLock.Lock()
+		gcNamespace(&namespaces.Items[i], dryRun)
+		eLock.Unlock()
+	}
+	for i := range objects {
+		eLock.Lock()
+		gcObject(&objects[i], dryRun)
+		eLock.Unlock()
+	}
+}
+
+// Run the garbage collector every once in a while. It only logs what it would
+// delete unless MEL_GC_DRY_RUN is set to false
+func gcProcess() {
+	dryRun := GetEnv("MEL_GC_DRY_RUN", "true") != "false"
+	interval, err := strconv.Atoi(GetEnv("MEL_GC_INTERVAL", "600"))
+	if err != nil || interval <= 0 {
+		interval = 600
+	}
+	for {
+		time.Sleep(time.Duration(interval) * time.Second)
+		if unitTesting {
+			continue
+		}
+		waitKubeApi()
+		gcOrphans(dryRun)
+	}
+}
+
+//---------------------------------------Consul------------------------------------
+
+// The replicas of the consul server StatefulSet
+const consulServers = 1
+
+func renderConsul(remotes []string, partition int) string {
+	var wanJoin []string
+	for _, r := range remotes {
+		wanJoin = append(wanJoin, getGwName(r))
+	}
+	yaml := GetConsul(ConsulWanIP, ConsulStorage, MyCluster, wanJoin, consulServers, partition)
+	return AddOwnerLabels(yaml, ownerLabels("", "", "", -1))
+}
+
+// Consul is applied with the partition at consulServers so that no server pod is
+// upgraded right away, waitConsulReady then moves the partition down pod by pod
+func generateConsul(remotes []string, partition int) *manifest {
+	return renderManifest("consul.yaml", renderConsul(remotes, partition))
+}
+
+// The version of consul is the hash of its manifest, so a new template or a
+// change in the WAN IP/storage class is a new version
+func consulVersion() string {
+	h := fnv.New32a()
+	h.Write([]byte(renderConsul(ConsulRemotes, consulServers)))
+	return fmt.Sprintf("%x", h.Sum32())
+}
+
+func setConsulStatus(summary *ComponentSummary, status string) error {
+	summary.Status = status
+	summary.ChangeAt = time.Now().Format(time.RFC1123)
+	glog.Info("Consul ", summary.Version, ": ", status)
+	return DBUpdateComponentSummary(summary)
+}
+
+// The consul summary if version is still the one applied, nil otherwise
+func consulApplied(version string) *ComponentSummary {
+	err, summary := DBFindComponentSummary("consul")
+	if err != nil || summary == nil {
+		glog.Error("Cannot find consul summary for ", version, ": ", err)
+		return nil
+	}
+	if summary.Version != version {
+		return nil
+	}
+	return summary
+}
+
+// Runs in the background, nothing else waits for consul. The server pods are upgraded
+// one at a time from the highest ordinal down, each has to be ready before the partition
+// moves on to the next. A later apply has its own rollout, so this one stops as soon as
+// its version is not the one applied anymore
+func waitConsulReady(version string, remotes []string) {
+	var err error
+	name := MyCluster + "-consul-server"
+	for p := consulServers - 1; p >= 0 && err == nil; p-- {
+		if consulApplied(version) == nil {
+			return
+		}
+		err = kubectlApply(generateConsul(remotes, p))
+		if err == nil {
+			err = waitStatefulSetReady("consul-system", name, consulServers, consulServers-p, 10*time.Minute)
+		}
+	}
+	if err == nil {
+		err = waitDaemonSetReady("consul-system", MyCluster+"-consul", 10*time.Minute)
+	}
+	status := "ready"
+	if err != nil {
+		status = "notready: " + err.Error()
+	}
+	summary := consulApplied(version)
+	if summary == nil {
+		return
+	}
+	setConsulStatus(summary, status)
+}
+
+// Consul is applied only if its version is different from the one last applied,
+// the server pods are then rolled and checked for readiness in the background
+func createConsul() error {
+	var mf *manifest
+	cmd := exec.Command("kubectl", "create", "namespace", "consul-system")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		outs := string(out)
+		if !strings.Contains(outs, "AlreadyExists") {
+			glog.Error("Cannot create consul namespace: ", outs)
+			return err
+		}
+	}
+
+	err, summary := DBFindComponentSummary("consul")
+	if err != nil {
+		return err
+	}
+	if summary == nil {
+		summary = &ComponentSummary{Name: "consul"}
+	}
+	version := consulVersion()
+	if summary.Version == version {
+		if summary.Status != "ready" {
+			go waitConsulReady(version, append([]string{}, ConsulRemotes...))
+		}
+		return nil
+	}
+
+	if summary.Storage != "" && summary.Storage != ConsulStorage && !unitTesting {
+		// The volume claim templates of a StatefulSet cant be changed, so remove the
+		// StatefulSet leaving the pods (and their volumes) alone and create it again.
+		// The existing volumes stay on the old storage class, new ones use the new one
+		glog.Info("Consul storage class changing from ", summary.Storage, " to ", ConsulStorage)
+		cmd = exec.Command("kubectl", "delete", "statefulset", MyCluster+"-consul-server", "-n", "consul-system", "--cascade=orphan")
+		out, err = cmd.CombinedOutput()
+		if err != nil && !strings.Contains(string(out), "NotFound") {
+			kickKubeApi(string(out))
+			glog.Error("Cannot delete consul statefulset: ", string(out))
+			return err
+		}
+	}
 
-	file, err = generateDockerCred(ns)
+	mf = generateConsul(ConsulRemotes, consulServers)
+	err = kubectlApply(mf)
 	if err != nil {
-		return fnLine(), err
+		return err
 	}
-	err = kubectlApply(file)
+	summary.Version = version
+	summary.WanIP = ConsulWanIP
+	summary.Storage = ConsulStorage
+	summary.Remotes = ConsulRemotes
+	err = setConsulStatus(summary, "applied")
 	if err != nil {
-		return fnLine(), err
+		return err
 	}
+	go waitConsulReady(version, append([]string{}, ConsulRemotes...))
+	return nil
+}
 
-	file = generateTenantRouteReflector(ns)
-	if file == "" {
-		return fnLine(), errors.New("yaml fail")
-	}
-	err = kubectlApply(file)
+// Run a consul command on the consul server
+func consulExec(args ...string) (string, error) {
+	cmdArgs := append([]string{"exec", MyCluster + "-consul-server-0", "-n", "consul-system", "--", "consul"}, args...)
+	cmd := exec.Command("kubectl", cmdArgs...)
+	out, err := cmd.CombinedOutput()
 	if err != nil {
-		return fnLine(), err
+		kickKubeApi(string(out))
+		glog.Error("consul ", args, " failed: ", string(out))
 	}
+	return string(out), err
+}
 
-	return "", nil
+// A member of the consul WAN pool, as the agent's members api has it
+type consulMember struct {
+	Name string            `json:"Name"`
+	Addr string            `json:"Addr"`
+	Tags map[string]string `json:"Tags"`
 }
 
-func createTenants(clcfg *ClusterConfig) (string, error) {
-	t := tenants[clcfg.Tenant]
-	if t == nil || !t.created {
-		if t == nil {
-			tenants[clcfg.Tenant] = makeTenantInfo(clcfg.Tenant)
-			t = tenants[clcfg.Tenant]
-		}
-		// Unknown tenant, so create tenant dir, then namespace.
-		_ = os.Mkdir("/tmp/"+clcfg.Tenant, 0777)
-		errMsg, err := createNamespace(clcfg.Tenant)
-		if err != nil {
-			return errMsg, err
-		}
-		t.created = true
+// The WAN members from the consul server's http api, reached through the api server
+func consulWanMembers() ([]consulMember, error) {
+	path := "/api/v1/namespaces/consul-system/pods/" + MyCluster + "-consul-server-0:8500/proxy/v1/agent/members?wan=1"
+	cmd := exec.Command("kubectl", "get", "--raw", path)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		kickKubeApi(string(out))
+		glog.Error("Cannot get consul WAN members: ", string(out))
+		return nil, err
 	}
-	t.markSweep = true
-
-	if t.deployVersion != clcfg.Version {
-		errMsg, err := createAgentDeployments(clcfg)
-		if err != nil {
-			return errMsg, err
-		}
-		t.deployVersion = clcfg.Version
+	var members []consulMember
+	err = json.Unmarshal(out, &members)
+	if err != nil {
+		return nil, err
 	}
-	return "", nil
+	return members, nil
 }
 
-//---------------------------------------Consul------------------------------------
-
-func generateConsul() string {
-	yaml := GetConsul(ConsulWanIP, ConsulStorage, MyCluster)
-	return yamlFile("/tmp/consul.yaml", yaml)
+// The names of the WAN members in the datacenters (clusters) we dont federate with
+// anymore. The datacenter is in the dc tag, and the members are named <node>.<dc>
+func consulWanLeaving(members []consulMember, old map[string]bool) []string {
+	var names []string
+	for _, m := range members {
+		dc := m.Tags["dc"]
+		if dc == "" {
+			if i := strings.LastIndex(m.Name, "."); i != -1 {
+				dc = m.Name[i+1:]
+			}
+		}
+		if old[dc] {
+			names = append(names, m.Name)
+		}
+	}
+	return names
 }
 
-func createConsul() error {
-	var file string
-	cmd := exec.Command("kubectl", "create", "namespace", "consul-system")
-	out, err := cmd.CombinedOutput()
+// The WAN federation follows the remotes of our gateway. The retry_join_wan in the
+// server config takes care of consul restarts, and the remotes added/removed are
+// joined/force-left right away
+func updateConsulWan(remotes []string) error {
+	remotes = append([]string{}, remotes...)
+	sort.Strings(remotes)
+	err, summary := DBFindComponentSummary("consul")
 	if err != nil {
-		outs := string(out)
-		if !strings.Contains(outs, "AlreadyExists") {
-			glog.Error("Cannot create consul namespace: ", outs)
-			return err
-		}
+		return err
+	}
+	if summary == nil {
+		summary = &ComponentSummary{Name: "consul"}
+	}
+	ConsulRemotes = remotes
+	version := consulVersion()
+	if summary.Version == version {
+		return nil
+	}
+	mf := generateConsul(ConsulRemotes, consulServers)
+	err = kubectlApply(mf)
+	if err != nil {
+		return err
 	}
 
-	for {
-		file = generateConsul()
-		if file != "" {
-			break
+	if !unitTesting {
+		old := make(map[string]bool)
+		for _, r := range summary.Remotes {
+			old[r] = true
+		}
+		var join []string
+		for _, r := range remotes {
+			if !old[r] {
+				join = append(join, getGwName(r))
+			}
+			delete(old, r)
+		}
+		if len(join) != 0 {
+			_, err = consulExec(append([]string{"join", "-wan"}, join...)...)
+			if err != nil {
+				return err
+			}
+		}
+		if len(old) != 0 {
+			members, err := consulWanMembers()
+			if err != nil {
+				return err
+			}
+			for _, name := range consulWanLeaving(members, old) {
+				_, err = consulExec("force-leave", "-prune", name)
+				if err != nil {
+					return err
+				}
+			}
 		}
-		// Well, no other option than to retry
-		time.Sleep(1 * time.Second)
 	}
-	err = kubectlApply(file)
+
+	summary.Version = version
+	summary.Remotes = remotes
+	err = setConsulStatus(summary, "wan updated")
 	if err != nil {
 		return err
 	}
+	go waitConsulReady(version, append([]string{}, ConsulRemotes...))
 	return nil
 }
 
 //-----------------------------------Gateways--------------------------------------
 
-func generateEgressGwDest(gateway string) string {
-	file := "/tmp/egwdst-" + gateway + ".yaml"
+func generateEgressGwDest(gateway string) *manifest {
+	name := "egwdst-" + gateway + ".yaml"
 	yaml := GetEgressGwDst(gateway)
-	return yamlFile(file, yaml)
+	yaml = AddOwnerLabels(yaml, ownerLabels("", "", "", -1))
+	return renderManifest(name, yaml)
 }
 
 func createEgressGwDest(gateway string) error {
-	file := generateEgressGwDest(gateway)
-	if file == "" {
-		return errors.New("yaml fail")
-	}
-	err := kubectlApply(file)
+	mf := generateEgressGwDest(gateway)
+	err := kubectlApply(mf)
 	if err != nil {
 		return err
 	}
@@ -1071,18 +3712,16 @@ func createEgressGwDest(gateway string) error {
 	return nil
 }
 
-func generateEgressGw(gateway string) string {
-	file := "/tmp/egw-" + gateway + ".yaml"
+func generateEgressGw(gateway string) *manifest {
+	name := "egw-" + gateway + ".yaml"
 	yaml := GetEgressGw(gateway)
-	return yamlFile(file, yaml)
+	yaml = AddOwnerLabels(yaml, ownerLabels("", "", "", -1))
+	return renderManifest(name, yaml)
 }
 
 func createEgressGw(gateway string) error {
-	file := generateEgressGw(gateway)
-	if file == "" {
-		return errors.New("yaml fail")
-	}
-	err := kubectlApply(file)
+	mf := generateEgressGw(gateway)
+	err := kubectlApply(mf)
 	if err != nil {
 		return err
 	}
@@ -1090,18 +3729,16 @@ func createEgressGw(gateway string) error {
 	return nil
 }
 
-func generateExtsvc(gateway string) string {
-	file := "/tmp/extsvc-" + gateway + ".yaml"
+func generateExtsvc(gateway string) *manifest {
+	name := "extsvc-" + gateway + ".yaml"
 	yaml := GetExtSvc(gateway)
-	return yamlFile(file, yaml)
+	yaml = AddOwnerLabels(yaml, ownerLabels("", "", "", -1))
+	return renderManifest(name, yaml)
 }
 
 func createExtsvc(gateway string) error {
-	file := generateExtsvc(gateway)
-	if file == "" {
-		return errors.New("yaml fail")
-	}
-	err := kubectlApply(file)
+	mf := generateExtsvc(gateway)
+	err := kubectlApply(mf)
 	if err != nil {
 		return err
 	}
@@ -1126,18 +3763,16 @@ func createEgressGws(gw string) (string, error) {
 	return "", nil
 }
 
-func generateIngressGw() string {
-	file := "/tmp/igw.yaml"
+func generateIngressGw() *manifest {
+	name := "igw.yaml"
 	yaml := GetIngressGw(getGwName(MyCluster))
-	return yamlFile(file, yaml)
+	yaml = AddOwnerLabels(yaml, ownerLabels("", "", "", -1))
+	return renderManifest(name, yaml)
 }
 
 func createIngressGw() error {
-	file := generateIngressGw()
-	if file == "" {
-		return errors.New("yaml fail")
-	}
-	err := kubectlApply(file)
+	mf := generateIngressGw()
+	err := kubectlApply(mf)
 	if err != nil {
 		return err
 	}
@@ -1166,6 +3801,10 @@ func createEgressGateways() (string, error) {
 			return errMsg, e
 		}
 	}
+	err = updateConsulWan(cl.Remotes)
+	if err != nil {
+		return fnLine(), err
+	}
 	eGwVersion = cl.Version
 	return "", nil
 }
@@ -1186,131 +3825,173 @@ func createIngressGateway() error {
 
 // Generate virtual service to handle user connections into a Cpod based
 // on x-nextensio-connect header whose value is currently the connector name
-func generateCpodNxtConnect(tenant string, connectid string) string {
-	file := "/tmp/" + tenant + "/nxtconnect-" + connectid + ".yaml"
+func generateCpodNxtConnect(tenant string, connectid string) *manifest {
+	name := tenant + "/nxtconnect-" + connectid + ".yaml"
 	yaml := GetCpodConnectService(tenant, getGwName(MyCluster), connectid)
-	return yamlFile(file, yaml)
+	yaml = AddOwnerLabels(yaml, ownerLabels(tenant, connectid, "", -1))
+	return renderManifest(name, yaml)
 }
 
-func deleteCpodNxtConnect(tenant string, connectid string) (string, string, error) {
-	file := generateCpodNxtConnect(tenant, connectid)
-	if file == "" {
-		return "", fnLine(), errors.New("yaml fail")
+// Number of active downstream connections into the cpod replicas, as the
+// sidecar of each replica sees it
+func cpodSessions(tenant string, connectid string, replicas int) (int, error) {
+	if unitTesting {
+		return 0, nil
+	}
+	sessions := 0
+	for i := 0; i < replicas; i++ {
+		pod := connectid + fmt.Sprintf("-%d", i)
+		cmd := exec.Command("kubectl", "exec", pod, "-n", common.TenantToNamespace(tenant), "-c", "istio-proxy", "--",
+			"pilot-agent", "request", "GET", "stats?filter=downstream_cx_active")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			if strings.Contains(string(out), "NotFound") {
+				continue
+			}
+			kickKubeApi(string(out))
+			return 0, errors.New(string(out))
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			// Only the connections coming into the pod matter
+			if !strings.Contains(line, "inbound") {
+				continue
+			}
+			kv := strings.Split(line, ": ")
+			if len(kv) != 2 {
+				continue
+			}
+			n, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+			if err == nil {
+				sessions += n
+			}
+		}
 	}
-	out, err := kubectlDelete(file)
-	return file, out, err
+	return sessions, nil
 }
 
-func createCpodNxtConnect(a ClusterBundle) error {
-	file := generateCpodNxtConnect(a.Tenant, a.Connectid)
-	if file == "" {
-		return errors.New("yaml fail")
+// If the tenant wants connectors drained, the x-nextensio-connect route is removed first
+// so that no new sessions land on the cpods, and the rest of the connector is deleted only
+// after ConnectorDrain seconds or when there are no more sessions, whichever is earlier.
+// Till then errConnectorDraining is returned so that the delete is retried
+func drainConnector(tenant string, t *tenantInfo, c *ConnectorSummary) (string, error) {
+	drain := t.tenantSummary.ConnectorDrain
+	if drain <= 0 {
+		return "", nil
+	}
+	if !c.Draining {
+		mf, out, err := deleteCpodNxtConnect(tenant, c.Connectid)
+		if err != nil && !strings.Contains(out, "NotFound") {
+			return fnLine(), err
+		}
+		mf.discard()
+		c.Draining = true
+		c.DrainStart = time.Now().Unix()
+		err = DBUpdateTenantSummary(tenant, t.tenantSummary)
+		if err != nil {
+			c.Draining = false
+			return fnLine(), err
+		}
+		glog.Info("Draining connector ", tenant, " ", c.Connectid)
+		return fnLine(), errConnectorDraining
+	}
+	if time.Now().Unix()-c.DrainStart >= int64(drain) {
+		glog.Info("Drain period over for connector ", tenant, " ", c.Connectid)
+		return "", nil
 	}
-	return kubectlApply(file)
+	sessions, err := cpodSessions(tenant, c.Connectid, c.CpodRepl)
+	if err != nil {
+		// Cant tell, so wait for the drain period to be over
+		glog.Error("Cannot get sessions of connector ", tenant, " ", c.Connectid, ": ", err)
+		return fnLine(), errConnectorDraining
+	}
+	if sessions != 0 {
+		return fnLine(), errConnectorDraining
+	}
+	glog.Info("Connector drained ", tenant, " ", c.Connectid)
+	return "", nil
+}
+
+func deleteCpodNxtConnect(tenant string, connectid string) (*manifest, string, error) {
+	mf := generateCpodNxtConnect(tenant, connectid)
+	out, err := kubectlDelete(mf)
+	return mf, out, err
+}
+
+func addCpodNxtConnect(batch *applyBatch, a ClusterBundle) {
+	batch.add(generateCpodNxtConnect(a.Tenant, a.Connectid))
 }
 
 // Generate virtual service to handle Cpod to Apod traffic based on x-nextensio-for
 // header whose value is a pod name
-func generateNxtForCpodReplica(t string, podname string, idx int) string {
+func generateNxtForCpodReplica(t string, podname string, idx int) *manifest {
 	hostname := podname + fmt.Sprintf("-%d", idx)
-	file := "/tmp/" + t + "/nxtfor-" + hostname + ".yaml"
+	name := t + "/nxtfor-" + hostname + ".yaml"
 	yaml := GetNxtForCpodServiceReplica(t, getGwName(MyCluster), podname, hostname)
-	return yamlFile(file, yaml)
+	yaml = AddOwnerLabels(yaml, ownerLabels(t, podname, "", idx))
+	return renderManifest(name, yaml)
 }
 
-func createNxtForCpodReplica(t string, podname string, replicas int) error {
-	var err error
-	var file string
+func addNxtForCpodReplica(batch *applyBatch, t string, podname string, replicas int) {
 	for i := 0; i < replicas; i++ {
 		// Repeat for each replica
-		file = generateNxtForCpodReplica(t, podname, i)
-		if file == "" {
-			err = errors.New("yaml fail")
-		} else {
-			err1 := kubectlApply(file)
-			if err1 != nil {
-				err = err1
-			}
-		}
+		batch.add(generateNxtForCpodReplica(t, podname, i))
 	}
-	return err
 }
 
 func deleteNxtForCpodReplica(t string, podname string, replicaStart int, replicaEnd int) error {
-	var file string
+	var mf *manifest
 	for i := replicaStart; i < replicaEnd; i++ {
 		// Repeat for each replica
-		file = generateNxtForCpodReplica(t, podname, i)
-		if file == "" {
-			return errors.New("yaml fail")
-		} else {
-			out, err := kubectlDelete(file)
-			if err != nil && !strings.Contains(out, "NotFound") {
-				return err
-			}
-			os.Remove(file)
+		mf = generateNxtForCpodReplica(t, podname, i)
+		out, err := kubectlDelete(mf)
+		if err != nil && !strings.Contains(out, "NotFound") {
+			return err
 		}
+		mf.discard()
 	}
 	return nil
 }
 
 // Generate virtual service to handle user connections into a Cpod based
 // on x-nextensio-for header whose value is currently the connector name
-func generateCpodNxtFor(tenant string, connectid string) string {
-	file := "/tmp/" + tenant + "/nxtfor-" + connectid + ".yaml"
+func generateCpodNxtFor(tenant string, connectid string) *manifest {
+	name := tenant + "/nxtfor-" + connectid + ".yaml"
 	yaml := GetNxtForCpodService(tenant, getGwName(MyCluster), connectid)
-	return yamlFile(file, yaml)
+	yaml = AddOwnerLabels(yaml, ownerLabels(tenant, connectid, "", -1))
+	return renderManifest(name, yaml)
 }
 
-func deleteCpodNxtFor(tenant string, connectid string) (string, string, error) {
-	file := generateCpodNxtFor(tenant, connectid)
-	if file == "" {
-		return "", fnLine(), errors.New("yaml fail")
-	}
-	out, err := kubectlDelete(file)
-	return file, out, err
+func deleteCpodNxtFor(tenant string, connectid string) (*manifest, string, error) {
+	mf := generateCpodNxtFor(tenant, connectid)
+	out, err := kubectlDelete(mf)
+	return mf, out, err
 }
 
-func createCpodNxtFor(a ClusterBundle) error {
-	file := generateCpodNxtFor(a.Tenant, a.Connectid)
-	if file == "" {
-		return errors.New("yaml fail")
-	}
-	return kubectlApply(file)
+func addCpodNxtFor(batch *applyBatch, a ClusterBundle) {
+	batch.add(generateCpodNxtFor(a.Tenant, a.Connectid))
 }
 
 // Generate service for inter-cluster traffic coming into an Apod
-func generateCpodInServiceReplica(tenant string, podname string, idx int) string {
+func generateCpodInServiceReplica(tenant string, podname string, idx int) *manifest {
 	hostname := podname + fmt.Sprintf("-%d", idx)
-	file := "/tmp/" + tenant + "/service-inside-" + hostname + ".yaml"
+	name := tenant + "/service-inside-" + hostname + ".yaml"
 	yaml := GetCpodInServiceReplica(tenant, podname, hostname)
-	return yamlFile(file, yaml)
+	yaml = AddOwnerLabels(yaml, ownerLabels(tenant, podname, "", idx))
+	return renderManifest(name, yaml)
 }
 
-func createCpodServiceReplica(tenant string, podname string, replicas int) error {
+func addCpodServiceReplica(batch *applyBatch, tenant string, podname string, replicas int) {
 	for i := 0; i < replicas; i++ {
 		// Repeat for each replica
-		file := generateCpodInServiceReplica(tenant, podname, i)
-		if file == "" {
-			return errors.New("yaml fail")
-		} else {
-			err := kubectlApply(file)
-			if err != nil {
-				return err
-			}
-		}
+		batch.add(generateCpodInServiceReplica(tenant, podname, i))
 	}
-	return nil
 }
 
 func deleteCpodServiceReplica(tenant string, podname string, replicaStart int, replicaEnd int) error {
 	for i := replicaStart; i < replicaEnd; i++ {
 		// Repeat for each replica
-		file := generateCpodInServiceReplica(tenant, podname, i)
-		if file == "" {
-			return errors.New("yaml fail")
-		}
-		out, err := kubectlDelete(file)
+		mf := generateCpodInServiceReplica(tenant, podname, i)
+		out, err := kubectlDelete(mf)
 		// clustermgr might have crashed while in here and come back up and now
 		// we might be trying to delete something thats already deleted, so dont
 		// panic in that case
@@ -1318,105 +3999,45 @@ func deleteCpodServiceReplica(tenant string, podname string, replicaStart int, r
 			glog.Error("Inside service del failed,", i)
 			return err
 		}
-		os.Remove(file)
+		mf.discard()
 	}
 	return nil
 }
 
-func deleteCpodInService(tenant string, podname string) (string, string, error) {
-	file := generateCpodInService(tenant, podname)
-	if file == "" {
-		return "", fnLine(), errors.New("yaml fail")
-	} else {
-		out, err := kubectlDelete(file)
-		return file, out, err
-	}
+func deleteCpodInService(tenant string, podname string) (*manifest, string, error) {
+	mf := generateCpodInService(tenant, podname)
+	out, err := kubectlDelete(mf)
+	return mf, out, err
 }
 
-func createCpodInService(tenant string, podname string) error {
-	file := generateCpodInService(tenant, podname)
-	if file == "" {
-		return errors.New("yaml fail")
-	} else {
-		return kubectlApply(file)
-	}
+func addCpodInService(batch *applyBatch, tenant string, podname string) {
+	batch.add(generateCpodInService(tenant, podname))
 }
 
-func deleteCpodOutService(tenant string, podname string) (string, string, error) {
-	file := generateCpodOutService(tenant, podname)
-	if file == "" {
-		return "", fnLine(), errors.New("yaml fail")
-	} else {
-		out, err := kubectlDelete(file)
-		return file, out, err
-	}
+func deleteCpodOutService(tenant string, podname string) (*manifest, string, error) {
+	mf := generateCpodOutService(tenant, podname)
+	out, err := kubectlDelete(mf)
+	return mf, out, err
 }
 
-func createCpodOutService(tenant string, podname string) error {
-	file := generateCpodOutService(tenant, podname)
-	if file == "" {
-		return errors.New("yaml fail")
-	} else {
-		return kubectlApply(file)
-	}
+func addCpodOutService(batch *applyBatch, tenant string, podname string) {
+	batch.add(generateCpodOutService(tenant, podname))
 }
 
-func createOneConnector(b ClusterBundle, ct *ClusterConfig) (string, error) {
-	file := generateCpodDeploy(ct.Tenant, ct.Image, b.Connectid, b.CpodRepl)
-	if file == "" {
-		glog.Error("Cpod deploy file failed", ct.Tenant, b.Connectid)
-		return fnLine(), errors.New("Cannot create bundle file")
-	}
-	err := kubectlApply(file)
-	if err != nil {
-		glog.Error("Cpod deploy apply failed", err, ct.Tenant, b.Connectid)
-		return fnLine(), err
-	}
-	err = createCpodOutService(ct.Tenant, b.Connectid)
-	if err != nil {
-		glog.Error("Cpod service failed", err, ct.Tenant, b.Connectid)
-		return fnLine(), err
-	}
-	err = createCpodInService(ct.Tenant, b.Connectid)
-	if err != nil {
-		glog.Error("Cpod service failed", err, ct.Tenant, b.Connectid)
-		return fnLine(), err
-	}
-	err = createCpodServiceReplica(ct.Tenant, b.Connectid, b.CpodRepl)
-	if err != nil {
-		glog.Error("Cpod service replica failed", err, ct.Tenant, b.Connectid)
-		return fnLine(), err
-	}
-	if err := createCpodNxtFor(b); err != nil {
-		glog.Error("Cpod for failed", err, ct.Tenant, b.Connectid)
-		return fnLine(), err
-	}
-	if err := createNxtForCpodReplica(ct.Tenant, b.Connectid, b.CpodRepl); err != nil {
-		glog.Error("Cpod for replica failed", err, ct.Tenant, b.Connectid)
-		return fnLine(), err
-	}
-	if err := createCpodNxtConnect(b); err != nil {
-		glog.Error("Cpod connect failed", err, ct.Tenant, b.Connectid)
-		return fnLine(), err
-	}
-	file = generateCpodHealth(ct.Tenant, b.Connectid)
-	if file == "" {
-		glog.Error("Pod health file failed", ct.Tenant, b.Connectid)
-		return fnLine(), errors.New("Cannot create health file")
-	}
-	err = kubectlApply(file)
-	if err != nil {
-		glog.Error("Pod health apply failed", err, ct.Tenant, b.Connectid)
-		return fnLine(), err
-	}
-	file = generateCpodHeadless(ct.Tenant, b.Connectid)
-	if file == "" {
-		glog.Error("Pod headless file failed", ct.Tenant, b.Connectid)
-		return fnLine(), errors.New("Cannot create headless file")
-	}
-	err = kubectlApply(file)
-	if err != nil {
-		glog.Error("Pod headless apply failed", err, ct.Tenant, b.Connectid)
+// All the objects of the connector go in one batch apply
+func createOneConnector(b ClusterBundle, ct *ClusterConfig, c *ConnectorSummary) (string, error) {
+	batch := newApplyBatch(ct.Tenant, b.Connectid)
+	batch.add(generateCpodDeploy(ct.Tenant, c.Image, b.Connectid, b.CpodRepl, &c.Resources))
+	addCpodOutService(batch, ct.Tenant, b.Connectid)
+	addCpodInService(batch, ct.Tenant, b.Connectid)
+	addCpodServiceReplica(batch, ct.Tenant, b.Connectid, b.CpodRepl)
+	addCpodNxtFor(batch, b)
+	addNxtForCpodReplica(batch, ct.Tenant, b.Connectid, b.CpodRepl)
+	addCpodNxtConnect(batch, b)
+	batch.add(generateCpodHealth(ct.Tenant, b.Connectid))
+	batch.add(generateCpodHeadless(ct.Tenant, b.Connectid))
+	if err := batch.apply(); err != nil {
+		glog.Error("Cpod apply failed", err, ct.Tenant, b.Connectid)
 		return fnLine(), err
 	}
 
@@ -1427,81 +4048,113 @@ func createOneConnector(b ClusterBundle, ct *ClusterConfig) (string, error) {
 // we might be trying to delete something thats already deleted, so dont
 // panic incase kubectl delete returns a "NotFound" error
 func deleteOneConnector(tenant string, connectid string, c *ConnectorSummary) (string, error) {
-	file, out, err := deleteCpodNxtFor(tenant, connectid)
+	mf, out, err := deleteCpodNxtFor(tenant, connectid)
 	if err != nil && !strings.Contains(out, "NotFound") {
 		glog.Error("Cpod for failed", err, tenant, connectid)
 		return fnLine(), err
 	}
-	os.Remove(file)
+	mf.discard()
 	err = deleteNxtForCpodReplica(tenant, connectid, 0, c.CpodRepl)
 	if err != nil {
 		glog.Error("Cpod nxtfor delete replicas failed", err, tenant, connectid, c.CpodRepl)
 		return fnLine(), err
 	}
-	file, out, err = deleteCpodNxtConnect(tenant, connectid)
+	mf, out, err = deleteCpodNxtConnect(tenant, connectid)
 	if err != nil && !strings.Contains(out, "NotFound") {
 		glog.Error("Cpod connect failed", err, tenant, connectid)
 		return fnLine(), err
 	}
-	os.Remove(file)
-	file, out, err = deleteCpodOutService(tenant, connectid)
+	mf.discard()
+	mf, out, err = deleteCpodOutService(tenant, connectid)
 	if err != nil && !strings.Contains(out, "NotFound") {
 		glog.Error("Cpod service failed", err, tenant, connectid)
 		return fnLine(), err
 	}
-	os.Remove(file)
-	file, out, err = deleteCpodInService(tenant, connectid)
+	mf.discard()
+	mf, out, err = deleteCpodInService(tenant, connectid)
 	if err != nil && !strings.Contains(out, "NotFound") {
 		glog.Error("Cpod service failed", err, tenant, connectid)
 		return fnLine(), err
 	}
-	os.Remove(file)
+	mf.discard()
 	err = deleteCpodServiceReplica(tenant, connectid, 0, c.CpodRepl)
 	if err != nil {
 		glog.Error("Cpod service delete replicas failed", err, tenant, connectid, c.CpodRepl)
 		return fnLine(), err
 	}
-	file = generateCpodHealth(tenant, connectid)
-	if file == "" {
-		glog.Error("Pod health file failed", tenant, connectid)
-		return fnLine(), errors.New("Cannot create health file")
-	}
-	out, err = kubectlDelete(file)
+	mf = generateCpodHealth(tenant, connectid)
+	out, err = kubectlDelete(mf)
 	if err != nil && !strings.Contains(out, "NotFound") {
 		glog.Error("Pod health delete failed", err, tenant, connectid)
 		return fnLine(), err
 	}
-	os.Remove(file)
-	file = generateCpodHeadless(tenant, connectid)
-	if file == "" {
-		glog.Error("Pod headless file failed", tenant, connectid)
-		return fnLine(), errors.New("Cannot create health file")
-	}
-	out, err = kubectlDelete(file)
+	mf.discard()
+	mf = generateCpodHeadless(tenant, connectid)
+	out, err = kubectlDelete(mf)
 	if err != nil && !strings.Contains(out, "NotFound") {
 		glog.Error("Pod headless delete failed", err, tenant, connectid)
 		return fnLine(), err
 	}
-	os.Remove(file)
-	file = generateCpodDeploy(tenant, c.Image, connectid, c.CpodRepl)
-	if file == "" {
-		glog.Error("Cpod deploy file failed", tenant, connectid)
-		return fnLine(), errors.New("Cannot create bundle file")
-	}
-	out, err = kubectlDelete(file)
+	mf.discard()
+	mf = generateCpodDeploy(tenant, c.Image, connectid, c.CpodRepl, &c.Resources)
+	out, err = kubectlDelete(mf)
 	if err != nil && !strings.Contains(out, "NotFound") {
 		glog.Error("Cpod deploy delete failed", err, tenant, connectid)
 		return fnLine(), err
 	}
-	os.Remove(file)
+	mf.discard()
 
 	return "", nil
 }
 
+func sameResources(a *PodResources, b *PodResources) bool {
+	if a.CpuRequest != b.CpuRequest || a.CpuLimit != b.CpuLimit ||
+		a.MemRequest != b.MemRequest || a.MemLimit != b.MemLimit {
+		return false
+	}
+	if len(a.NodeSelector) != len(b.NodeSelector) {
+		return false
+	}
+	for k, v := range a.NodeSelector {
+		if bv, ok := b.NodeSelector[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// The percentage selection hashes the connector id, so a connector stays in (or out of)
+// the canary as long as the percentage doesnt change
+func isCanary(b *ClusterBundle, ct *ClusterConfig) bool {
+	for _, c := range ct.CanaryConnectors {
+		if c == b.Connectid || c == b.Uid {
+			return true
+		}
+	}
+	h := fnv.New32a()
+	h.Write([]byte(b.Connectid))
+	return int(h.Sum32()%100) < ct.CanaryPercent
+}
+
+// An image configured in the bundle itself wins over the tenant's canary/stable images
+func connectorImage(b *ClusterBundle, ct *ClusterConfig) (string, bool) {
+	if b.Image != "" {
+		return b.Image, false
+	}
+	if ct.CanaryImage != "" && isCanary(b, ct) {
+		return ct.CanaryImage, true
+	}
+	return ct.Image, false
+}
+
 func createConnectors(ct *ClusterConfig) (string, error) {
 	var errMsg string
 
 	t := tenants[ct.Tenant]
+	if t.tenantSummary.Terminating != "" {
+		// The tenant delete takes care of the connectors
+		return "", nil
+	}
 	for _, c := range t.tenantSummary.Connectors {
 		binfo := t.bundleInfo[c.Connectid]
 		if binfo == nil {
@@ -1524,16 +4177,24 @@ func createConnectors(ct *ClusterConfig) (string, error) {
 			t.bundleInfo[b.Connectid] = binfo
 		}
 		binfo.markSweep = true
-		if binfo.version != b.Version {
-			sumIdx := -1
-			for i, c := range t.tenantSummary.Connectors {
-				if c.Connectid == b.Connectid {
-					sumIdx = i
-					break
-				}
+		image, canary := connectorImage(&b, ct)
+		sumIdx := -1
+		for i, c := range t.tenantSummary.Connectors {
+			if c.Connectid == b.Connectid {
+				sumIdx = i
+				break
 			}
+		}
+		// The bundle might be the same, but if the tenant image changed under it or the
+		// summary doesnt match what we want, the cpods need to be redeployed anyways
+		changed := sumIdx == -1
+		if sumIdx != -1 {
+			c := &t.tenantSummary.Connectors[sumIdx]
+			changed = c.Image != image || c.Canary != canary || !sameResources(&c.Resources, &b.Resources) || c.Draining
+		}
+		if binfo.version != b.Version || changed {
 			if sumIdx == -1 {
-				s := ConnectorSummary{Id: b.Uid, Image: ct.Image, Connectid: b.Connectid, CpodRepl: b.CpodRepl}
+				s := ConnectorSummary{Id: b.Uid, Image: image, Connectid: b.Connectid, CpodRepl: b.CpodRepl, Resources: b.Resources, Canary: canary}
 				t.tenantSummary.Connectors = append(t.tenantSummary.Connectors, s)
 				sumIdx = len(t.tenantSummary.Connectors) - 1
 			}
@@ -1550,8 +4211,13 @@ func createConnectors(ct *ClusterConfig) (string, error) {
 				glog.Error("Cpod service delete replicas failed", ct.Tenant, b.Connectid, b.CpodRepl, summary.CpodRepl)
 				return fnLine(), err
 			}
-			summary.Image = ct.Image
+			summary.Image = image
+			summary.Canary = canary
 			summary.CpodRepl = b.CpodRepl
+			summary.Resources = b.Resources
+			// The connector came back while it was being drained
+			summary.Draining = false
+			summary.DrainStart = 0
 			// Update the latest values first BEFORE trying to apply kubectl.
 			// If we crash in the midst of applying kubectl, we need to have
 			// the summary database reflect what we were attempting, a delete
@@ -1561,38 +4227,42 @@ func createConnectors(ct *ClusterConfig) (string, error) {
 			if err != nil {
 				return fnLine(), err
 			}
-			errMsg, err = createOneConnector(b, ct)
+			errMsg, err = createOneConnector(b, ct, summary)
 			if err != nil {
 				return errMsg, err
 			}
 			binfo.version = b.Version
+			watchReady(ct.Tenant, b.Uid, b.Connectid, b.CpodRepl, b.Version, rolloutTimeout(ct), "")
 			glog.Info("Cpod success ", ct.Tenant, b.Connectid)
 		}
 	}
+	if t.tenantSummary.CanaryImage != ct.CanaryImage || t.tenantSummary.ConnectorDrain != ct.ConnectorDrain {
+		t.tenantSummary.CanaryImage = ct.CanaryImage
+		t.tenantSummary.ConnectorDrain = ct.ConnectorDrain
+		err = DBUpdateTenantSummary(ct.Tenant, t.tenantSummary)
+		if err != nil {
+			return fnLine(), err
+		}
+	}
 
 	// Till we have mongo notifications working, do a mark and sweep and delete bundles
-	// that are still marked as false
-	for i, c := range t.tenantSummary.Connectors {
+	// that are still marked as false. A connector that is still draining is not an error
+	// of this config, so its delete is left to the retries instead of failing the caller.
+	// The deletes remove connectors from the summary, so find the stale ones first
+	var stale []string
+	for _, c := range t.tenantSummary.Connectors {
 		if !t.bundleInfo[c.Connectid].markSweep {
-			// First delete from kubectl and THEN update the summary database that then
-			// entry has been deleted, so that if we crash in the midst of a delete, we
-			// will still continue attempting a delete when we come back up next time.
-			// Trying to delete non existant stuff will return a NotFound and we handle that
-			// gracefully
-			errMsg, err = deleteOneConnector(ct.Tenant, c.Connectid, &c)
-			if err != nil {
-				return errMsg, err
-			}
-			l := len(t.tenantSummary.Connectors) - 1
-			t.tenantSummary.Connectors[i] = t.tenantSummary.Connectors[l]
-			t.tenantSummary.Connectors = t.tenantSummary.Connectors[0:l]
-			err = DBUpdateTenantSummary(ct.Tenant, t.tenantSummary)
-			if err != nil {
-				// put it back and try again next time
-				t.tenantSummary.Connectors = append(t.tenantSummary.Connectors, c)
-				return fnLine(), err
-			}
-			delete(t.bundleInfo, c.Connectid)
+			stale = append(stale, c.Id)
+		}
+	}
+	for _, id := range stale {
+		errMsg, err = deleteConnector(ct.Tenant, id)
+		if errors.Is(err, errConnectorDraining) {
+			retryConnectorDelete(ct.Tenant, id, errMsg, err)
+			continue
+		}
+		if err != nil {
+			return errMsg, err
 		}
 	}
 
@@ -1627,10 +4297,23 @@ func melMain() {
 	if MyJaeger == "UNKNOWN_JAEGER" {
 		glog.Fatal("Unknown Jaeger URI")
 	}
+	OtelExporter = GetEnv("OTEL_EXPORTER_ENDPOINT", "otel-collector.observability.svc.cluster.local:4317")
+	PullSecrets = strings.Split(GetEnv("PULL_SECRETS", "regcred"), ",")
+	DebugDir = GetEnv("MEL_DEBUG_DIR", "")
+	for _, k := range strings.Split(GetEnv("MEL_APPLY_FORCE_KINDS", ""), ",") {
+		if k != "" {
+			ApplyForceKinds = append(ApplyForceKinds, k)
+		}
+	}
+	IngressPrincipal = GetEnv("ISTIO_INGRESS_PRINCIPAL", "cluster.local/ns/istio-system/sa/istio-ingressgateway-service-account")
 	TestEnviron := GetEnv("TEST_ENVIRONMENT", "NOT_TEST")
 	if TestEnviron == "true" {
 		unitTesting = true
 	}
+	if !unitTesting {
+		go kubeApiMonitor()
+		go statusServer(GetEnv("MEL_STATUS_ADDR", ":8090"))
+	}
 
 	//TODO: These versions will go away once we move to mongodb changeset
 	//notifications, this is a temporary poor man's hack to periodically poll
@@ -1640,17 +4323,23 @@ func melMain() {
 	tenants = make(map[string]*tenantInfo)
 	errRecList = make(map[string]*ErrStack)
 
-	// Create consul
 	for {
-		if createConsul() == nil {
+		if DBConnect() {
+			dbConnected = true
 			break
 		}
 		time.Sleep(1 * time.Second)
 	}
 
+	// Create consul, the version applied is tracked in the DB. Start with the remotes
+	// we already know of, so that consul isnt re-applied without them
+	err, cl := DBFindGatewayCluster(getGwName(MyCluster))
+	if err == nil && cl != nil {
+		ConsulRemotes = append([]string{}, cl.Remotes...)
+		sort.Strings(ConsulRemotes)
+	}
 	for {
-		if DBConnect() {
-			dbConnected = true
+		if createConsul() == nil {
 			break
 		}
 		time.Sleep(1 * time.Second)
@@ -1664,7 +4353,6 @@ func melMain() {
 				// Copy s to tSum var so that we can assign the address to tenantSummary as s's addr
 				// doesn't change in the for loop
 				tSum := s
-				_ = os.Mkdir("/tmp/"+s.Tenant, 0777)
 				tenants[s.Tenant] = makeTenantInfo(tSum.Tenant)
 				tenants[s.Tenant].tenantSummary = &tSum
 			}
@@ -1690,6 +4378,21 @@ func melMain() {
 		time.Sleep(time.Second)
 	}
 
+	// Finish the tenant deletes that were in progress when we crashed, the tenants
+	// that were added back meanwhile are then created afresh below. A delete that
+	// cant finish right away (like connectors still draining) is left to the retries,
+	// the other tenants dont have to wait for it
+	for k, t := range tenants {
+		if t.tenantSummary.Terminating == "" {
+			continue
+		}
+		errMsg, err := deleteNamespace(k, t)
+		if err != nil {
+			glog.Error("Cannot resume tenant delete ", k, ": ", err)
+			addError(err, errMsg, "delete", "NxtTenants", k, "")
+		}
+	}
+
 	// Do a mark and sweep of tenants if the tenant hasn't been removed properly
 	for _, t := range tenants {
 		t.markSweep = false
@@ -1699,6 +4402,12 @@ func melMain() {
 		err, clTcfg := DBFindAllTenantsInCluster()
 		for _, Tcfg := range clTcfg {
 			glog.Infof("Tenants in  %v:- <%v>", MyCluster, Tcfg.Tenant)
+			if t := tenants[Tcfg.Tenant]; t != nil && t.tenantSummary.Terminating != "" {
+				// Still being deleted, the retries create it once the delete is done
+				t.markSweep = true
+				addError(errors.New("Tenant is terminating: "+Tcfg.Tenant), fnLine(), "insert", "NxtTenants", Tcfg.Tenant, "")
+				continue
+			}
 			for {
 				_, err := createTenants(&Tcfg)
 				if err == nil {
@@ -1725,19 +4434,10 @@ func melMain() {
 	for k, t := range tenants {
 		// If its still marked as false, then there is no such tenant
 		if !t.markSweep {
-			for {
-				for _, c := range t.tenantSummary.Connectors {
-					errMsg, err := deleteConnector(t.tenantSummary.Tenant, c.Id)
-					if err != nil {
-						glog.Error("Mark and Sweep: Cannot delete connector", c.Id, err, errMsg)
-					}
-				}
-				_, err := deleteNamespace(k, t)
-				if err == nil {
-					break
-				}
-				glog.Error("Mark and Sweep: Cannot delete namespace", err)
-				time.Sleep(2 * time.Second)
+			errMsg, err := deleteNamespace(k, t)
+			if err != nil {
+				glog.Error("Mark and Sweep: Cannot delete namespace ", k, ": ", err)
+				addError(err, errMsg, "delete", "NxtTenants", k, "")
 			}
 		}
 	}
@@ -1745,8 +4445,14 @@ func melMain() {
 	// After we have run through the entire database once above,
 	// register Cluster database for event notification and start event
 	// based actions beyond this point
+	go eventProcess()
 	go watchClusterDB(clusterDB)
 	go errRetryProcess()
+	go apodScaleProcess()
+	go pullSecretProcess()
+	go gcProcess()
+	go statusProcess()
+	go readinessProcess()
 
 	// Do kill -USR1 <pid of mel> to get debugging info
 	sigc := make(chan os.Signal, 1)
@@ -14,28 +14,16 @@ export TEST_ENVIRONMENT=true
 # 172.18.0.2 mongodb-2-service.default.svc.cluster.local
 export MY_MONGO_URI=mongodb://172.18.0.2:27017,172.18.0.2:27018,172.18.0.2:27019/
 export MY_JAEGER_COLLECTOR=none
+# The test compares the rendered yamls with the ones in test/yamls, so have mel
+# write them out to /tmp/<tenant>/
+export MEL_DEBUG_DIR=/tmp
 
-sed -i -e "s|REPLACE_MONGO_URI|$MY_MONGO_URI|g" ./test/yamls/nextensio/apod1_1/deploy-nextensio-apod1.yaml
-sed -i -e "s|REPLACE_MONGO_URI|$MY_MONGO_URI|g" ./test/yamls/nextensio/foobar2/deploy-nextensio-foobar-nextensio-com.yaml
-sed -i -e "s|REPLACE_MONGO_URI|$MY_MONGO_URI|g" ./test/yamls/nextensio/foobar1/deploy-nextensio-foobar-nextensio-com.yaml
-sed -i -e "s|REPLACE_MONGO_URI|$MY_MONGO_URI|g" ./test/yamls/nextensio/apod2_2/deploy-nextensio-apod1.yaml
-sed -i -e "s|REPLACE_MONGO_URI|$MY_MONGO_URI|g" ./test/yamls/nextensio/apod2_2/deploy-nextensio-apod2.yaml
-sed -i -e "s|REPLACE_MONGO_URI|$MY_MONGO_URI|g" ./test/yamls/nextensio/kismis1/deploy-nextensio-kismis-nextensio-com.yaml
-
-sed -i -e "s|REPLACE_MONGO_URI|$MY_MONGO_URI|g" ./test/yamls/dogfood/apod1_1/deploy-dogfood-apod1.yaml
-sed -i -e "s|REPLACE_MONGO_URI|$MY_MONGO_URI|g" ./test/yamls/dogfood/apod2_2/deploy-dogfood-apod1.yaml
-sed -i -e "s|REPLACE_MONGO_URI|$MY_MONGO_URI|g" ./test/yamls/dogfood/apod2_2/deploy-dogfood-apod2.yaml
-sed -i -e "s|REPLACE_MONGO_URI|$MY_MONGO_URI|g" ./test/yamls/dogfood/kismis1/deploy-dogfood-kismis-dogfood-com.yaml
+# The tests of the helpers dont need mongo or kubernetes
+go test -run 'TestGetResources|TestGetFlowMapping|TestGetCpodDeployLiteral|TestIsCanary|TestConnectorImage|TestDesiredApod|TestGetApodDeployReplicas|TestGetTenantQuota|TestAddOwnerLabels|TestGcOrphan|TestManifestKinds|TestApplyRank|TestApplyResults|TestGetTenantAuthz|TestGetTenantSecret|TestGetOtelCollector|TestConsulWanLeaving'
 
 # We cant let go test run all of the tests in paralell because
 # all of them use the same "mel". So run them serially here
 go test -run TestBasicWithNoErrors
 go test -run TestBasicWithKubeErrors
 go test -run TestBasicWithMongoErrors
-
-git checkout -- ./test/yamls/nextensio/apod1_1/deploy-nextensio-apod1.yaml
-git checkout -- ./test/yamls/nextensio/foobar2/deploy-nextensio-foobar-nextensio-com.yaml
-git checkout -- ./test/yamls/nextensio/foobar1/deploy-nextensio-foobar-nextensio-com.yaml
-git checkout -- ./test/yamls/nextensio/apod2_2/deploy-nextensio-apod1.yaml
-git checkout -- ./test/yamls/nextensio/apod2_2/deploy-nextensio-apod2.yaml
-git checkout -- ./test/yamls/nextensio/kismis1/deploy-nextensio-kismis-nextensio-com.yaml
+go test -run TestRollingRevert
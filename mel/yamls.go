@@ -5,9 +5,121 @@ import (
 	"io/ioutil"
 	"log"
 	"regexp"
+	"sort"
 	"strings"
+
+	common "gitlab.com/nextensio/common/go"
 )
 
+// The resources are rendered as a yaml flow mapping so that it fits in the one
+// line of the template, no resources at all renders as an empty mapping {}
+func GetResources(res *PodResources) string {
+	var requests []string
+	var limits []string
+	if res.CpuRequest != "" {
+		requests = append(requests, fmt.Sprintf("cpu: %q", res.CpuRequest))
+	}
+	if res.MemRequest != "" {
+		requests = append(requests, fmt.Sprintf("memory: %q", res.MemRequest))
+	}
+	if res.CpuLimit != "" {
+		limits = append(limits, fmt.Sprintf("cpu: %q", res.CpuLimit))
+	}
+	if res.MemLimit != "" {
+		limits = append(limits, fmt.Sprintf("memory: %q", res.MemLimit))
+	}
+	var resources []string
+	if len(requests) != 0 {
+		resources = append(resources, "requests: {"+strings.Join(requests, ", ")+"}")
+	}
+	if len(limits) != 0 {
+		resources = append(resources, "limits: {"+strings.Join(limits, ", ")+"}")
+	}
+	return "{" + strings.Join(resources, ", ") + "}"
+}
+
+// A map of strings rendered as a flow mapping, sorted so that the same map
+// always renders the same yaml
+func GetFlowMapping(m map[string]string) string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var entries []string
+	for _, k := range keys {
+		entries = append(entries, fmt.Sprintf("%q: %q", k, m[k]))
+	}
+	return "{" + strings.Join(entries, ", ") + "}"
+}
+
+// The labels are added to the top level metadata of every object in the yaml, along
+// with the labels the object already has in the template. Objects which have their
+// labels as a flow mapping are left alone, they get all their labels from mel anyways
+func AddOwnerLabels(yaml string, labels map[string]string) string {
+	var keys []string
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var owner []string
+	for _, k := range keys {
+		owner = append(owner, fmt.Sprintf("    %q: %q", k, labels[k]))
+	}
+
+	lines := strings.Split(yaml, "\n")
+	var out []string
+	for i := 0; i < len(lines); i++ {
+		out = append(out, lines[i])
+		if strings.TrimRight(lines[i], " ") != "metadata:" {
+			continue
+		}
+		// Look for labels in this metadata block, the block ends at the
+		// next line thats not indented
+		labelsAt := -1
+		flow := false
+		for j := i + 1; j < len(lines); j++ {
+			if lines[j] != "" && !strings.HasPrefix(lines[j], " ") {
+				break
+			}
+			if strings.TrimRight(lines[j], " ") == "  labels:" {
+				labelsAt = j
+				break
+			}
+			if strings.HasPrefix(lines[j], "  labels:") {
+				flow = true
+				break
+			}
+		}
+		if flow {
+			continue
+		}
+		if labelsAt == -1 {
+			out = append(out, "  labels:")
+		} else {
+			out = append(out, lines[i+1:labelsAt+1]...)
+			i = labelsAt
+		}
+		out = append(out, owner...)
+	}
+	return strings.Join(out, "\n")
+}
+
+// Same as resources, the node selector is a flow mapping
+func GetNodeSelector(res *PodResources) string {
+	return GetFlowMapping(res.NodeSelector)
+}
+
+// The pull secrets are a flow sequence of the names of the secrets copied into
+// the tenant namespace
+func GetPullSecrets() string {
+	var secrets []string
+	for _, s := range PullSecrets {
+		secrets = append(secrets, fmt.Sprintf("{name: %s}", s))
+	}
+	return "[" + strings.Join(secrets, ", ") + "]"
+}
+
 func GetApodConnectService(namespace string, gateway string, podname string) string {
 	content, err := ioutil.ReadFile(MyYaml + "/nextensio_connect_apod.yaml")
 	if err != nil {
@@ -219,61 +331,246 @@ func GetExtSvc(gateway string) string {
 	return svcRepl
 }
 
-func GetApodDeploy(namespace string, image string, mongo string, jaeger string, podname string, cluster string, replicas int) string {
+func GetApodDeploy(namespace string, image string, podname string, cluster string, replicas int, secretVersion int) string {
 	content, err := ioutil.ReadFile(MyYaml + "/deploy_apod.yaml")
 	if err != nil {
 		log.Fatal(err)
 	}
-	reJgrNspc := regexp.MustCompile(`REPLACE_NAMESPACE`)
-	jgrNspcRepl := reJgrNspc.ReplaceAllString(jaeger, namespace)
-
 	deploy := string(content)
 	reNspc := regexp.MustCompile(`REPLACE_NAMESPACE`)
 	nspcRepl := reNspc.ReplaceAllString(deploy, namespace)
 	reImg := regexp.MustCompile(`REPLACE_IMAGE`)
 	deplRepl := reImg.ReplaceAllString(nspcRepl, image)
-	reMongo := regexp.MustCompile(`REPLACE_MONGO`)
-	mongoRepl := reMongo.ReplaceAllString(deplRepl, mongo)
-	reJaeger := regexp.MustCompile(`REPLACE_JAEGER`)
-	jaegerRepl := reJaeger.ReplaceAllString(mongoRepl, jgrNspcRepl)
 	rePod := regexp.MustCompile(`REPLACE_POD_NAME`)
-	podRepl := rePod.ReplaceAllString(jaegerRepl, podname)
+	podRepl := rePod.ReplaceAllString(deplRepl, podname)
 	reClu := regexp.MustCompile(`REPLACE_CLUSTER`)
 	cluRepl := reClu.ReplaceAllString(podRepl, cluster)
+	if replicas < 0 {
+		// The replicas are left to the HPA
+		reRepl := regexp.MustCompile(`(?m)^ *replicas: REPLACE_REPLICAS\n`)
+		cluRepl = reRepl.ReplaceAllString(cluRepl, "")
+	}
 	reRepl := regexp.MustCompile(`REPLACE_REPLICAS`)
 	replRepl := reRepl.ReplaceAllString(cluRepl, fmt.Sprintf("%d", replicas))
+	reVer := regexp.MustCompile(`REPLACE_SECRET_VERSION`)
+	replRepl = reVer.ReplaceAllString(replRepl, fmt.Sprintf("%d", secretVersion))
+	reSec := regexp.MustCompile(`REPLACE_PULL_SECRETS`)
+	secRepl := reSec.ReplaceAllString(replRepl, GetPullSecrets())
 
-	return replRepl
+	return secRepl
 }
 
-func GetCpodDeploy(namespace string, image string, mongo string, jaeger string, podname string, cluster string, replicas int) string {
+func GetCpodDeploy(namespace string, image string, podname string, cluster string, replicas int, secretVersion int, res *PodResources) string {
 	content, err := ioutil.ReadFile(MyYaml + "/deploy_cpod.yaml")
 	if err != nil {
 		log.Fatal(err)
 	}
-	reJgrNspc := regexp.MustCompile(`REPLACE_NAMESPACE`)
-	jgrNspcRepl := reJgrNspc.ReplaceAllString(jaeger, namespace)
-
 	deploy := string(content)
 	reNspc := regexp.MustCompile(`REPLACE_NAMESPACE`)
 	nspcRepl := reNspc.ReplaceAllString(deploy, namespace)
 	reImg := regexp.MustCompile(`REPLACE_IMAGE`)
 	deplRepl := reImg.ReplaceAllString(nspcRepl, image)
-	reMongo := regexp.MustCompile(`REPLACE_MONGO`)
-	mongoRepl := reMongo.ReplaceAllString(deplRepl, mongo)
-	reJaeger := regexp.MustCompile(`REPLACE_JAEGER`)
-	jaegerRepl := reJaeger.ReplaceAllString(mongoRepl, jgrNspcRepl)
 	rePod := regexp.MustCompile(`REPLACE_POD_NAME`)
-	podRepl := rePod.ReplaceAllString(jaegerRepl, podname)
+	podRepl := rePod.ReplaceAllString(deplRepl, podname)
 	reClu := regexp.MustCompile(`REPLACE_CLUSTER`)
 	cluRepl := reClu.ReplaceAllString(podRepl, cluster)
 	reRepl := regexp.MustCompile(`REPLACE_REPLICAS`)
 	replRepl := reRepl.ReplaceAllString(cluRepl, fmt.Sprintf("%d", replicas))
+	reVer := regexp.MustCompile(`REPLACE_SECRET_VERSION`)
+	replRepl = reVer.ReplaceAllString(replRepl, fmt.Sprintf("%d", secretVersion))
+	reRes := regexp.MustCompile(`REPLACE_RESOURCES`)
+	resRepl := reRes.ReplaceAllLiteralString(replRepl, GetResources(res))
+	reSel := regexp.MustCompile(`REPLACE_NODE_SELECTOR`)
+	selRepl := reSel.ReplaceAllLiteralString(resRepl, GetNodeSelector(res))
+	reSec := regexp.MustCompile(`REPLACE_PULL_SECRETS`)
+	secRepl := reSec.ReplaceAllString(selRepl, GetPullSecrets())
+
+	return secRepl
+}
+
+func GetNamespace(namespace string, labels map[string]string, annotations map[string]string) string {
+	content, err := ioutil.ReadFile(MyYaml + "/namespace.yaml")
+	if err != nil {
+		log.Fatal(err)
+	}
+	nspc := string(content)
+	reNspc := regexp.MustCompile(`REPLACE_NAMESPACE`)
+	nspcRepl := reNspc.ReplaceAllString(nspc, namespace)
+	reLbl := regexp.MustCompile(`REPLACE_LABELS`)
+	lblRepl := reLbl.ReplaceAllLiteralString(nspcRepl, GetFlowMapping(labels))
+	reAnn := regexp.MustCompile(`REPLACE_ANNOTATIONS`)
+	annRepl := reAnn.ReplaceAllLiteralString(lblRepl, GetFlowMapping(annotations))
+
+	return annRepl
+}
+
+// The exporter comes from the tenant's config, so its quoted and replaced literally
+func GetOtelCollector(namespace string, exporter string) string {
+	content, err := ioutil.ReadFile(MyYaml + "/otel_collector.yaml")
+	if err != nil {
+		log.Fatal(err)
+	}
+	otel := string(content)
+	reNspc := regexp.MustCompile(`REPLACE_NAMESPACE`)
+	nspcRepl := reNspc.ReplaceAllString(otel, namespace)
+	reExp := regexp.MustCompile(`REPLACE_EXPORTER`)
+	expRepl := reExp.ReplaceAllLiteralString(nspcRepl, fmt.Sprintf("%q", exporter))
+
+	return expRepl
+}
+
+// The involved object is the tenant's namespace if kind is Namespace, else its an object in
+// the namespace. The message can have anything in it, so its quoted and replaced literally
+func GetEvent(namespace string, kind string, object string, eventName string, eventType string, reason string, message string, when string) string {
+	content, err := ioutil.ReadFile(MyYaml + "/event.yaml")
+	if err != nil {
+		log.Fatal(err)
+	}
+	apiVersion := "apps/v1"
+	objNamespace := common.TenantToNamespace(namespace)
+	if kind == "Namespace" {
+		apiVersion = "v1"
+		objNamespace = ""
+	}
+	event := string(content)
+	reNspc := regexp.MustCompile(`REPLACE_NAMESPACE`)
+	nspcRepl := reNspc.ReplaceAllString(event, namespace)
+	reName := regexp.MustCompile(`REPLACE_EVENT_NAME`)
+	nameRepl := reName.ReplaceAllString(nspcRepl, eventName)
+	reApi := regexp.MustCompile(`REPLACE_API_VERSION`)
+	apiRepl := reApi.ReplaceAllString(nameRepl, apiVersion)
+	reKind := regexp.MustCompile(`REPLACE_KIND`)
+	kindRepl := reKind.ReplaceAllString(apiRepl, kind)
+	reObj := regexp.MustCompile(`REPLACE_OBJECT_NAME`)
+	objRepl := reObj.ReplaceAllString(kindRepl, object)
+	reObjNspc := regexp.MustCompile(`REPLACE_OBJECT_NAMESPACE`)
+	objNspcRepl := reObjNspc.ReplaceAllString(objRepl, objNamespace)
+	reType := regexp.MustCompile(`REPLACE_TYPE`)
+	typeRepl := reType.ReplaceAllString(objNspcRepl, eventType)
+	reReason := regexp.MustCompile(`REPLACE_REASON`)
+	reasonRepl := reReason.ReplaceAllString(typeRepl, reason)
+	reTime := regexp.MustCompile(`REPLACE_TIME`)
+	timeRepl := reTime.ReplaceAllString(reasonRepl, when)
+	reMsg := regexp.MustCompile(`REPLACE_MESSAGE`)
+	msgRepl := reMsg.ReplaceAllLiteralString(timeRepl, fmt.Sprintf("%q", message))
+
+	return msgRepl
+}
+
+func GetTenantAuthz(namespace string, principal string) string {
+	content, err := ioutil.ReadFile(MyYaml + "/tenant_authz.yaml")
+	if err != nil {
+		log.Fatal(err)
+	}
+	authz := string(content)
+	reNspc := regexp.MustCompile(`REPLACE_NAMESPACE`)
+	nspcRepl := reNspc.ReplaceAllString(authz, namespace)
+	rePrin := regexp.MustCompile(`REPLACE_INGRESS_PRINCIPAL`)
+	prinRepl := rePrin.ReplaceAllString(nspcRepl, principal)
+
+	return prinRepl
+}
+
+func GetNetworkPolicy(namespace string) string {
+	content, err := ioutil.ReadFile(MyYaml + "/network_policy.yaml")
+	if err != nil {
+		log.Fatal(err)
+	}
+	np := string(content)
+	reNspc := regexp.MustCompile(`REPLACE_NAMESPACE`)
+	nspcRepl := reNspc.ReplaceAllString(np, namespace)
+
+	return nspcRepl
+}
+
+func GetNetworkPolicyExceptions(namespace string, allow []string) string {
+	content, err := ioutil.ReadFile(MyYaml + "/network_policy_exceptions.yaml")
+	if err != nil {
+		log.Fatal(err)
+	}
+	var from []string
+	for _, a := range allow {
+		from = append(from, fmt.Sprintf("{namespaceSelector: {matchLabels: {\"kubernetes.io/metadata.name\": %q}}}", a))
+	}
+	np := string(content)
+	reNspc := regexp.MustCompile(`REPLACE_NAMESPACE`)
+	nspcRepl := reNspc.ReplaceAllString(np, namespace)
+	reFrom := regexp.MustCompile(`REPLACE_ALLOW_FROM`)
+	fromRepl := reFrom.ReplaceAllString(nspcRepl, "["+strings.Join(from, ", ")+"]")
+
+	return fromRepl
+}
+
+// The requests of containers that dont ask for anything, when the tenant's quota
+// doesnt say
+const (
+	defaultCpuRequest    = "100m"
+	defaultMemoryRequest = "128Mi"
+)
+
+func GetTenantQuota(namespace string, quota *TenantQuota) string {
+	content, err := ioutil.ReadFile(MyYaml + "/tenant_quota.yaml")
+	if err != nil {
+		log.Fatal(err)
+	}
+	var hard []string
+	if quota.Cpu != "" {
+		hard = append(hard, fmt.Sprintf("requests.cpu: %q", quota.Cpu))
+	}
+	if quota.Memory != "" {
+		hard = append(hard, fmt.Sprintf("requests.memory: %q", quota.Memory))
+	}
+	if quota.Pods != 0 {
+		hard = append(hard, fmt.Sprintf("pods: \"%d\"", quota.Pods))
+	}
+	if quota.Services != 0 {
+		hard = append(hard, fmt.Sprintf("services: \"%d\"", quota.Services))
+	}
+	// Kubernetes refuses pods without requests when there is a quota on them
+	var request []string
+	if quota.DefaultCpu != "" {
+		request = append(request, fmt.Sprintf("cpu: %q", quota.DefaultCpu))
+	} else if quota.Cpu != "" {
+		request = append(request, fmt.Sprintf("cpu: %q", defaultCpuRequest))
+	}
+	if quota.DefaultMemory != "" {
+		request = append(request, fmt.Sprintf("memory: %q", quota.DefaultMemory))
+	} else if quota.Memory != "" {
+		request = append(request, fmt.Sprintf("memory: %q", defaultMemoryRequest))
+	}
+	fc := string(content)
+	reNspc := regexp.MustCompile(`REPLACE_NAMESPACE`)
+	nspcRepl := reNspc.ReplaceAllString(fc, namespace)
+	reQuota := regexp.MustCompile(`REPLACE_QUOTA`)
+	quotaRepl := reQuota.ReplaceAllString(nspcRepl, "{"+strings.Join(hard, ", ")+"}")
+	reReq := regexp.MustCompile(`REPLACE_DEFAULT_REQUEST`)
+	reqRepl := reReq.ReplaceAllString(quotaRepl, "{"+strings.Join(request, ", ")+"}")
 
-	return replRepl
+	return reqRepl
 }
 
-func GetConsul(myip string, storage string, cluster string) string {
+func GetApodHpa(namespace string, podname string, minReplicas int, maxReplicas int, cpuTarget int) string {
+	content, err := ioutil.ReadFile(MyYaml + "/hpa_apod.yaml")
+	if err != nil {
+		log.Fatal(err)
+	}
+	hpa := string(content)
+	reNspc := regexp.MustCompile(`REPLACE_NAMESPACE`)
+	nspcRepl := reNspc.ReplaceAllString(hpa, namespace)
+	rePod := regexp.MustCompile(`REPLACE_POD_NAME`)
+	podRepl := rePod.ReplaceAllString(nspcRepl, podname)
+	reMin := regexp.MustCompile(`REPLACE_MIN_REPLICAS`)
+	minRepl := reMin.ReplaceAllString(podRepl, fmt.Sprintf("%d", minReplicas))
+	reMax := regexp.MustCompile(`REPLACE_MAX_REPLICAS`)
+	maxRepl := reMax.ReplaceAllString(minRepl, fmt.Sprintf("%d", maxReplicas))
+	reCpu := regexp.MustCompile(`REPLACE_CPU_TARGET`)
+	cpuRepl := reCpu.ReplaceAllString(maxRepl, fmt.Sprintf("%d", cpuTarget))
+
+	return cpuRepl
+}
+
+// The server pods from partition on are upgraded to this manifest, the rest stay as they are
+func GetConsul(myip string, storage string, cluster string, wanJoin []string, replicas int, partition int) string {
 	content, err := ioutil.ReadFile(MyYaml + "/consul.yaml")
 	if err != nil {
 		log.Fatal(err)
@@ -285,38 +582,78 @@ func GetConsul(myip string, storage string, cluster string) string {
 	clusRepl := reClus.ReplaceAllString(csRepl, cluster)
 	reStorage := regexp.MustCompile(`REPLACE_STORAGE`)
 	storageRepl := reStorage.ReplaceAllString(clusRepl, storage)
+	var join []string
+	for _, w := range wanJoin {
+		join = append(join, fmt.Sprintf("%q", w))
+	}
+	reJoin := regexp.MustCompile(`REPLACE_RETRY_JOIN_WAN`)
+	joinRepl := reJoin.ReplaceAllString(storageRepl, "["+strings.Join(join, ", ")+"]")
+	reRepl := regexp.MustCompile(`REPLACE_REPLICAS`)
+	replRepl := reRepl.ReplaceAllString(joinRepl, fmt.Sprintf("%d", replicas))
+	rePart := regexp.MustCompile(`REPLACE_PARTITION`)
+	partRepl := rePart.ReplaceAllString(replRepl, fmt.Sprintf("%d", partition))
 
-	return storageRepl
+	return partRepl
 }
 
-func GetRouteReflector(namespace string, cluster string, mongo string) string {
+// An empty image picks the default image for the testbed or production
+func GetRouteReflector(namespace string, cluster string, image string, replicas int, secretVersion int, res *PodResources) string {
 	content, err := ioutil.ReadFile(MyYaml + "/route_reflector.yaml")
 	if err != nil {
 		log.Fatal(err)
 	}
-	var image string
-	var policy string
-	devTest := GetEnv("DEVELOPER_TESTBED", "false")
-	if devTest == "true" {
-		policy = "IfNotPresent"
-		image = "registry.gitlab.com/nextensio/routereflector/consul-rr:latest"
-	} else {
-		policy = "Always"
-		image = "registry.gitlab.com/nextensio/routereflector/consul-rr:production"
+	policy := "IfNotPresent"
+	if image == "" {
+		devTest := GetEnv("DEVELOPER_TESTBED", "false")
+		if devTest == "true" {
+			image = "registry.gitlab.com/nextensio/routereflector/consul-rr:latest"
+		} else {
+			policy = "Always"
+			image = "registry.gitlab.com/nextensio/routereflector/consul-rr:production"
+		}
 	}
 	fc := string(content)
 	reNspc := regexp.MustCompile(`REPLACE_NAMESPACE`)
 	nspcRepl := reNspc.ReplaceAllString(fc, namespace)
 	reClus := regexp.MustCompile(`REPLACE_CLUSTER`)
 	clusRepl := reClus.ReplaceAllString(nspcRepl, cluster)
-	reMongo := regexp.MustCompile(`REPLACE_MONGO`)
-	mongoRepl := reMongo.ReplaceAllString(clusRepl, mongo)
+	reVer := regexp.MustCompile(`REPLACE_SECRET_VERSION`)
+	verRepl := reVer.ReplaceAllString(clusRepl, fmt.Sprintf("%d", secretVersion))
 	reImg := regexp.MustCompile(`REPLACE_IMAGE`)
-	imgRepl := reImg.ReplaceAllString(mongoRepl, image)
+	imgRepl := reImg.ReplaceAllString(verRepl, image)
 	rePol := regexp.MustCompile(`REPLACE_PULL_POLICY`)
 	polRepl := rePol.ReplaceAllString(imgRepl, policy)
+	reSec := regexp.MustCompile(`REPLACE_PULL_SECRETS`)
+	secRepl := reSec.ReplaceAllString(polRepl, GetPullSecrets())
+	reRepl := regexp.MustCompile(`REPLACE_REPLICAS`)
+	replRepl := reRepl.ReplaceAllString(secRepl, fmt.Sprintf("%d", replicas))
+	reRes := regexp.MustCompile(`REPLACE_RESOURCES`)
+	resRepl := reRes.ReplaceAllLiteralString(replRepl, GetResources(res))
+	reSel := regexp.MustCompile(`REPLACE_NODE_SELECTOR`)
+	selRepl := reSel.ReplaceAllLiteralString(resRepl, GetNodeSelector(res))
+
+	return selRepl
+}
+
+// The URIs can have anything in them (like a $ or a quote in a password), so they are
+// quoted and replaced literally
+func GetTenantSecret(namespace string, mongo string, jaeger string) string {
+	content, err := ioutil.ReadFile(MyYaml + "/tenant_secret.yaml")
+	if err != nil {
+		log.Fatal(err)
+	}
+	reJgrNspc := regexp.MustCompile(`REPLACE_NAMESPACE`)
+	jgrNspcRepl := reJgrNspc.ReplaceAllLiteralString(jaeger, namespace)
+
+	secret := string(content)
+	reNspc := regexp.MustCompile(`REPLACE_NAMESPACE`)
+	nspcRepl := reNspc.ReplaceAllString(secret, namespace)
+	reMongo := regexp.MustCompile(`REPLACE_MONGO`)
+	mongoRepl := reMongo.ReplaceAllLiteralString(nspcRepl, fmt.Sprintf("%q", mongo))
+	reJaeger := regexp.MustCompile(`REPLACE_JAEGER`)
+	jaegerRepl := reJaeger.ReplaceAllLiteralString(mongoRepl, fmt.Sprintf("%q", jgrNspcRepl))
 
-	return polRepl
+	return jaegerRepl
 }
 
 func GetFlowControl(namespace string) string {